@@ -17,10 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/nvmf"
@@ -38,40 +41,80 @@ func init() {
 	flag.BoolVar(&conf.IsControllerServer, "IsControllerServer", false, "also run as controller service")
 	flag.StringVar(&conf.DriverName, "drivername", nvmf.DefaultDriverName, "CSI Driver")
 	flag.StringVar(&conf.Region, "region", "test_region", "Region")
+	flag.StringVar(&conf.Zone, "zone", "", "Zone, reported as topology segment when set")
+	flag.StringVar(&conf.Fabrics, "fabrics", "", "comma separated fabrics the node can reach, or the controller's target is exported on")
 	flag.StringVar(&conf.Version, "version", nvmf.DefaultDriverVersion, "Version")
 	flag.StringVar(&conf.NVMfVolumeMapDir, "nvmfVolumeMapDir", nvmf.DefaultVolumeMapPath, "Persistent volume")
+	flag.DurationVar(&conf.HealthInterval, "healthInterval", nvmf.DefaultHealthInterval, "interval between controller health checks, 0 disables them")
+	flag.StringVar(&conf.CgroupRoot, "cgroupRoot", nvmf.DefaultCgroupRoot, "cgroup v2 mount point where the I/O limits of volumes are set on their pods")
+	flag.DurationVar(&conf.TrimInterval, "trimInterval", 0, "interval between fstrim runs on mounted volumes, 0 only trims when requested by the <drivername>/fstrim PVC annotation")
+	flag.StringVar(&conf.Backend.Name, "backend", nvmf.BackendNone, "provisioning backend of the controller service and of inline volumes on nodes: \"\" (static provisioning only) or nvmet")
+	flag.StringVar(&conf.Backend.NvmetDataDir, "nvmetDataDir", nvmf.DefaultNvmetDataDir, "nvmet backend: directory holding volume and snapshot images")
+	flag.StringVar(&conf.Backend.NvmetPort, "nvmetPort", nvmf.DefaultNvmetPort, "nvmet backend: configfs port to export volumes on")
+	flag.StringVar(&conf.Backend.NvmetNqnPrefix, "nvmetNqnPrefix", nvmf.DefaultNvmetNqnPrefix, "nvmet backend: prefix of the subsystem nqn of each volume")
+	flag.DurationVar(&conf.ShutdownTimeout, "shutdownTimeout", nvmf.DefaultShutdownTimeout, "time to wait for in-flight operations on SIGTERM/SIGINT")
 }
 
 func main() {
 	flag.Parse()
 	flag.CommandLine.Parse([]string{})
-	runDriver()
+	if err := runDriver(); err != nil {
+		klog.Errorf("CSI exited with error: %v", err)
+		klog.Flush()
+		os.Exit(1)
+	}
+	klog.Flush()
 }
 
-func runDriver() {
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		driver := nvmf.NewDriver(&conf)
-		driver.Run(&conf)
-	}()
+func runDriver() error {
+	driver, err := nvmf.NewDriver(&conf)
+	if err != nil {
+		return err
+	}
 
 	servicePort := os.Getenv("SERVICE_PORT")
 	if len(servicePort) == 0 || servicePort == "" {
 		servicePort = nvmf.DefaultDriverServicePort
 	}
 
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/metrics", driver.MetricsHandler)
+	server := &http.Server{Addr: ":" + servicePort, Handler: mux}
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- driver.Run(&conf)
+	}()
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
 	klog.Info("CSI is running")
-	server := &http.Server{Addr: ":" + servicePort}
-	http.HandleFunc("/healthz", healthHandler)
 
-	if err := server.ListenAndServe(); err != nil {
-		klog.Fatalf("Service health port listen and serve err : %s", err.Error())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+
+	var runErr error
+	select {
+	case sig := <-sigCh:
+		klog.Infof("Received signal %s, shutting down", sig)
+	case runErr = <-errCh:
+		klog.Errorf("CSI service stopped unexpectedly: %v", runErr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	if err := driver.Stop(ctx); err != nil {
+		klog.Errorf("Failed to stop driver gracefully: %v", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		klog.Errorf("Failed to stop health server gracefully: %v", err)
 	}
-	wg.Wait()
-	os.Exit(0)
+	return runErr
 }
 
 func healthHandler(w http.ResponseWriter, r *http.Request) {
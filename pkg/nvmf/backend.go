@@ -0,0 +1,163 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	BackendNone  = ""
+	BackendNvmet = "nvmet"
+)
+
+// backend IDs end up in file and configfs names, so they are restricted to a safe character set
+var backendIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+// BackendVolume is a namespace provisioned by the backend together with how nodes reach it.
+type BackendVolume struct {
+	ID         string
+	SizeBytes  int64
+	Nqn        string
+	DeviceUUID string
+	TargetAddr string
+	TargetPort string
+	Transport  string
+	// SourceSnapshotID is set when the volume was restored from a snapshot
+	SourceSnapshotID string
+	// SourceVolumeID is set when the volume was cloned from another volume
+	SourceVolumeID string
+	// CopyIncomplete is set while a volume created by CreateVolumeForCopy has not been filled completely
+	CopyIncomplete bool
+	// Shared is set when more than one host may connect to the namespace at a time
+	Shared bool
+	// ReadOnly is set when the namespace rejects writes
+	ReadOnly bool
+	// Encrypted is set when the namespace holds a LUKS container the node opens through dm-crypt
+	Encrypted bool
+	// MutableParameters are the parameters the volume was last modified to with ModifyVolume
+	MutableParameters map[string]string
+	// PublishedNodes are the nodes the volume is controller published to, ordered by ID
+	PublishedNodes []string
+	// Condition is the health of the namespace on the target
+	Condition BackendVolumeCondition
+}
+
+// BackendVolumeCondition reports whether the backend still serves a volume's namespace.
+type BackendVolumeCondition struct {
+	Abnormal bool
+	Message  string
+}
+
+// VolumeContext returns the volume context NodePublishVolume needs to connect to the namespace.
+func (v *BackendVolume) VolumeContext() map[string]string {
+	return map[string]string{
+		"targetTrAddr": v.TargetAddr,
+		"targetTrPort": v.TargetPort,
+		"targetTrType": v.Transport,
+		"nqn":          v.Nqn,
+		deviceUUIDKey:  v.DeviceUUID,
+		encryptionKey:  strconv.FormatBool(v.Encrypted),
+	}
+}
+
+// BackendSnapshot is a point-in-time copy of a backend volume.
+type BackendSnapshot struct {
+	ID             string
+	SourceVolumeID string
+	SizeBytes      int64
+	CreationTime   time.Time
+	ReadyToUse     bool
+	// Encrypted is set when the snapshot holds a LUKS container
+	Encrypted bool
+}
+
+// Backend provisions NVMe-oF namespaces for the controller service.
+// Implementations must be idempotent: creating an existing object with compatible arguments returns it,
+// creating it with incompatible ones returns a *AlreadyExistsError and deleting a missing object succeeds.
+type Backend interface {
+	// CreateVolume creates and exports a namespace of at least sizeBytes
+	CreateVolume(name string, sizeBytes int64, params map[string]string) (*BackendVolume, error)
+	// CreateVolumeFromSnapshot creates and exports a namespace holding a copy of the snapshot
+	CreateVolumeFromSnapshot(name, snapshotID string, sizeBytes int64, params map[string]string) (*BackendVolume, error)
+	// CloneVolume creates and exports a namespace holding a copy of the source volume,
+	// it returns a *UnsupportedError when the backend cannot clone natively
+	CloneVolume(name, sourceVolumeID string, sizeBytes int64, params map[string]string) (*BackendVolume, error)
+	// CreateVolumeForCopy creates and exports an empty namespace recorded as an incomplete copy of the source
+	// volume, for the controller to fill; an existing copy of the same source is returned as it is
+	CreateVolumeForCopy(name, sourceVolumeID string, sizeBytes int64, params map[string]string) (*BackendVolume, error)
+	// CompleteVolumeCopy records that a volume created by CreateVolumeForCopy holds the whole source
+	CompleteVolumeCopy(volumeID string) error
+	// DeleteVolume unexports and removes a namespace
+	DeleteVolume(volumeID string) error
+	// GetVolume returns a *NotFoundError when the volume does not exist
+	GetVolume(volumeID string) (*BackendVolume, error)
+	// ModifyVolume applies mutable parameters to a namespace and records them in place of the ones set before,
+	// they are the complete parameters of a VolumeAttributesClass
+	ModifyVolume(volumeID string, params map[string]string) error
+	// ExpandVolume grows a namespace to at least sizeBytes, it never shrinks it
+	ExpandVolume(volumeID string, sizeBytes int64) (*BackendVolume, error)
+	// ListVolumes returns all volumes ordered by ID
+	ListVolumes() ([]*BackendVolume, error)
+	// PublishVolume records that the volume is published to nodeID
+	PublishVolume(volumeID, nodeID string) error
+	// UnpublishVolume forgets that the volume is published to nodeID
+	UnpublishVolume(volumeID, nodeID string) error
+
+	// GetCapacity returns the bytes available for new volumes created with the given parameters
+	GetCapacity(params map[string]string) (int64, error)
+
+	// CreateSnapshot takes a point-in-time snapshot of a volume
+	CreateSnapshot(name, sourceVolumeID string) (*BackendSnapshot, error)
+	// DeleteSnapshot removes a snapshot
+	DeleteSnapshot(snapshotID string) error
+	// GetSnapshot returns a *NotFoundError when the snapshot does not exist
+	GetSnapshot(snapshotID string) (*BackendSnapshot, error)
+	// ListSnapshots returns all snapshots ordered by ID
+	ListSnapshots() ([]*BackendSnapshot, error)
+}
+
+// BackendConfig holds the settings of every backend, only the ones of the selected backend are used.
+type BackendConfig struct {
+	Name string
+
+	NvmetDataDir   string // directory holding volume and snapshot images
+	NvmetPort      string // configfs port the subsystems are exported on
+	NvmetNqnPrefix string // subsystem nqn is <prefix>:<volumeID>
+}
+
+// NewBackend returns the configured backend, or nil when none is configured.
+func NewBackend(conf *BackendConfig) (Backend, error) {
+	switch conf.Name {
+	case BackendNone:
+		return nil, nil
+	case BackendNvmet:
+		return newNvmetBackend(conf)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", conf.Name)
+	}
+}
+
+func validateBackendID(id string) error {
+	if !backendIDRegexp.MatchString(id) {
+		return fmt.Errorf("invalid ID %q: must match %s", id, backendIDRegexp.String())
+	}
+	return nil
+}
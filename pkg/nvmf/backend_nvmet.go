@@ -0,0 +1,872 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	NVMET_CONFIGFS = "/sys/kernel/config/nvmet"
+
+	DefaultNvmetDataDir   = "/var/lib/csi-nvmf"
+	DefaultNvmetPort      = "1"
+	DefaultNvmetNqnPrefix = "nqn.2022-08.com.nvmf.csi"
+
+	// every volume is exported as namespace 1 of its own subsystem
+	nvmetNamespaceID = "1"
+	imageSuffix      = ".img"
+	metaSuffix       = ".json"
+	copyChunkSize    = 1 << 20
+)
+
+// nvmetBackend exports file-backed namespaces through the Linux kernel target configfs.
+// It must run on the target host. Volumes live in <dataDir>/volumes and snapshots in <dataDir>/snapshots,
+// each as a sparse image plus a json metadata file; snapshots are reflink copies of the volume image.
+type nvmetBackend struct {
+	mu        sync.Mutex
+	dataDir   string
+	port      string
+	nqnPrefix string
+}
+
+// nvmetVolumeMeta is persisted next to each volume image
+type nvmetVolumeMeta struct {
+	DeviceUUID       string
+	SourceSnapshotID string   `json:",omitempty"`
+	SourceVolumeID   string   `json:",omitempty"`
+	PublishedNodes   []string `json:",omitempty"`
+	Encrypted        bool     `json:",omitempty"`
+	DiscardOnDelete  bool     `json:",omitempty"`
+	// CopyIncomplete is set until the controller has copied the whole source volume
+	CopyIncomplete bool `json:",omitempty"`
+	// MutableParameters are recorded by ModifyVolume
+	MutableParameters map[string]string `json:",omitempty"`
+}
+
+// nvmetSnapshotMeta is persisted next to each snapshot image
+type nvmetSnapshotMeta struct {
+	SourceVolumeID string
+	CreationTime   time.Time
+	Encrypted      bool `json:",omitempty"`
+}
+
+func newNvmetBackend(conf *BackendConfig) (*nvmetBackend, error) {
+	b := &nvmetBackend{
+		dataDir:   conf.NvmetDataDir,
+		port:      conf.NvmetPort,
+		nqnPrefix: conf.NvmetNqnPrefix,
+	}
+	for _, dir := range []string{b.volumesDir(), b.snapshotsDir()} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return nil, fmt.Errorf("create backend dir %s: %v", dir, err)
+		}
+	}
+	if _, err := os.Stat(b.portDir()); err != nil {
+		return nil, fmt.Errorf("nvmet port %s not configured: %v", b.port, err)
+	}
+	klog.Infof("nvmet backend: data dir %s, port %s, nqn prefix %s", b.dataDir, b.port, b.nqnPrefix)
+	return b, nil
+}
+
+func (b *nvmetBackend) volumesDir() string {
+	return filepath.Join(b.dataDir, "volumes")
+}
+
+func (b *nvmetBackend) snapshotsDir() string {
+	return filepath.Join(b.dataDir, "snapshots")
+}
+
+func (b *nvmetBackend) portDir() string {
+	return filepath.Join(NVMET_CONFIGFS, "ports", b.port)
+}
+
+func (b *nvmetBackend) volumeImage(volumeID string) string {
+	return filepath.Join(b.volumesDir(), volumeID+imageSuffix)
+}
+
+func (b *nvmetBackend) snapshotImage(snapshotID string) string {
+	return filepath.Join(b.snapshotsDir(), snapshotID+imageSuffix)
+}
+
+func (b *nvmetBackend) nqn(volumeID string) string {
+	return b.nqnPrefix + ":" + volumeID
+}
+
+func (b *nvmetBackend) CreateVolume(name string, sizeBytes int64, params map[string]string) (*BackendVolume, error) {
+	if err := validateBackendID(name); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	encrypted, err := encryptionRequested(params)
+	if err != nil {
+		return nil, err
+	}
+	if vol, err := b.getVolume(name); err == nil {
+		if vol.SizeBytes < sizeBytes || vol.SourceSnapshotID != "" || vol.SourceVolumeID != "" {
+			return nil, &AlreadyExistsError{Kind: "volume", ID: name, Reason: "with a different size or content source"}
+		}
+		if err := b.checkVolumeParams(vol, params, encrypted); err != nil {
+			return nil, err
+		}
+		return vol, b.export(vol)
+	}
+
+	return b.createVolume(name, sizeBytes, params, &nvmetVolumeMeta{Encrypted: encrypted}, func(image string) error {
+		return nil
+	})
+}
+
+func (b *nvmetBackend) CreateVolumeFromSnapshot(name, snapshotID string, sizeBytes int64, params map[string]string) (*BackendVolume, error) {
+	if err := validateBackendID(name); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snap, err := b.getSnapshot(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if sizeBytes < snap.SizeBytes {
+		sizeBytes = snap.SizeBytes
+	}
+
+	if vol, err := b.getVolume(name); err == nil {
+		if vol.SizeBytes < sizeBytes || vol.SourceSnapshotID != snapshotID || vol.SourceVolumeID != "" {
+			return nil, &AlreadyExistsError{Kind: "volume", ID: name, Reason: "with a different size or content source"}
+		}
+		if err := b.checkVolumeParams(vol, params, snap.Encrypted); err != nil {
+			return nil, err
+		}
+		return vol, b.export(vol)
+	}
+
+	return b.createVolume(name, sizeBytes, params, &nvmetVolumeMeta{SourceSnapshotID: snapshotID, Encrypted: snap.Encrypted}, func(image string) error {
+		// snapshots are immutable, so a plain copy is as good as a reflink here
+		return cloneFile(b.snapshotImage(snapshotID), image, true)
+	})
+}
+
+// CloneVolume reflinks the source image. A copy of a volume in use would not be consistent,
+// so without reflink support the clone is left to the controller's generic block copy.
+func (b *nvmetBackend) CloneVolume(name, sourceVolumeID string, sizeBytes int64, params map[string]string) (*BackendVolume, error) {
+	if err := validateBackendID(name); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	src, err := b.getVolume(sourceVolumeID)
+	if err != nil {
+		return nil, err
+	}
+	if sizeBytes < src.SizeBytes {
+		sizeBytes = src.SizeBytes
+	}
+
+	if vol, err := b.getVolume(name); err == nil {
+		if vol.SizeBytes < sizeBytes || vol.SourceVolumeID != sourceVolumeID || vol.SourceSnapshotID != "" {
+			return nil, &AlreadyExistsError{Kind: "volume", ID: name, Reason: "with a different size or content source"}
+		}
+		if err := b.checkVolumeParams(vol, params, src.Encrypted); err != nil {
+			return nil, err
+		}
+		if vol.CopyIncomplete {
+			// an interrupted block copy of the controller, which has to finish it
+			return nil, &UnsupportedError{Operation: "clone", Reason: "block copy of volume " + name + " is incomplete"}
+		}
+		return vol, b.export(vol)
+	}
+
+	vol, err := b.createVolume(name, sizeBytes, params, &nvmetVolumeMeta{SourceVolumeID: sourceVolumeID, Encrypted: src.Encrypted}, func(image string) error {
+		return cloneFile(b.volumeImage(sourceVolumeID), image, false)
+	})
+	if err != nil && isReflinkUnsupported(err) {
+		return nil, &UnsupportedError{Operation: "clone", Reason: err.Error()}
+	}
+	return vol, err
+}
+
+func (b *nvmetBackend) CreateVolumeForCopy(name, sourceVolumeID string, sizeBytes int64, params map[string]string) (*BackendVolume, error) {
+	if err := validateBackendID(name); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	encrypted, err := encryptionRequested(params)
+	if err != nil {
+		return nil, err
+	}
+	if vol, err := b.getVolume(name); err == nil {
+		if vol.SizeBytes < sizeBytes || vol.SourceVolumeID != sourceVolumeID || vol.SourceSnapshotID != "" {
+			return nil, &AlreadyExistsError{Kind: "volume", ID: name, Reason: "with a different size or content source"}
+		}
+		if err := b.checkVolumeParams(vol, params, encrypted); err != nil {
+			return nil, err
+		}
+		return vol, b.export(vol)
+	}
+
+	meta := &nvmetVolumeMeta{SourceVolumeID: sourceVolumeID, Encrypted: encrypted, CopyIncomplete: true}
+	return b.createVolume(name, sizeBytes, params, meta, func(image string) error {
+		return nil
+	})
+}
+
+func (b *nvmetBackend) CompleteVolumeCopy(volumeID string) error {
+	if err := validateBackendID(volumeID); err != nil {
+		return &NotFoundError{Kind: "volume", ID: volumeID}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.getVolume(volumeID); err != nil {
+		return err
+	}
+	metaFile := filepath.Join(b.volumesDir(), volumeID+metaSuffix)
+	meta := &nvmetVolumeMeta{}
+	if err := readMeta(metaFile, meta); err != nil {
+		return err
+	}
+	meta.CopyIncomplete = false
+	return writeMeta(metaFile, meta)
+}
+
+// checkVolumeParams returns an *AlreadyExistsError when an existing volume was created with other parameters.
+func (b *nvmetBackend) checkVolumeParams(vol *BackendVolume, params map[string]string, encrypted bool) error {
+	if vol.Encrypted != encrypted {
+		return &AlreadyExistsError{Kind: "volume", ID: vol.ID, Reason: fmt.Sprintf("with %s %t", encryptionKey, vol.Encrypted)}
+	}
+	discard, err := discardOnDeleteRequested(params)
+	if err != nil {
+		return err
+	}
+	meta := &nvmetVolumeMeta{}
+	if err := readMeta(filepath.Join(b.volumesDir(), vol.ID+metaSuffix), meta); err != nil {
+		return err
+	}
+	if meta.DiscardOnDelete != discard {
+		return &AlreadyExistsError{Kind: "volume", ID: vol.ID, Reason: fmt.Sprintf("with %s %t", discardOnDeleteKey, meta.DiscardOnDelete)}
+	}
+	return nil
+}
+
+// createVolume creates the volume image, fills it with populate, grows it to sizeBytes and exports it.
+func (b *nvmetBackend) createVolume(name string, sizeBytes int64, params map[string]string, meta *nvmetVolumeMeta, populate func(image string) error) (vol *BackendVolume, err error) {
+	if meta.DiscardOnDelete, err = discardOnDeleteRequested(params); err != nil {
+		return nil, err
+	}
+	image := b.volumeImage(name)
+	// an image without metadata is a leftover of an interrupted create
+	if err = os.Remove(image); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("remove stale image %s: %v", image, err)
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(image)
+			os.Remove(strings.TrimSuffix(image, imageSuffix) + metaSuffix)
+		}
+	}()
+
+	if err = populate(image); err != nil {
+		return nil, fmt.Errorf("populate volume %s: %w", name, err)
+	}
+	if err = growImage(image, sizeBytes); err != nil {
+		return nil, err
+	}
+
+	if meta.DeviceUUID, err = newUUID(); err != nil {
+		return nil, err
+	}
+	if err = writeMeta(strings.TrimSuffix(image, imageSuffix)+metaSuffix, meta); err != nil {
+		return nil, err
+	}
+
+	if vol, err = b.getVolume(name); err != nil {
+		return nil, err
+	}
+	if err = b.export(vol); err != nil {
+		b.unexport(name)
+		return nil, err
+	}
+	klog.Infof("nvmet backend: created volume %s of %d bytes as %s", name, vol.SizeBytes, vol.Nqn)
+	return vol, nil
+}
+
+func (b *nvmetBackend) DeleteVolume(volumeID string) error {
+	if err := validateBackendID(volumeID); err != nil {
+		// no volume can exist under an invalid ID, so it is already deleted
+		klog.V(4).Infof("nvmet backend: delete volume: %v", err)
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.unexport(volumeID); err != nil {
+		return err
+	}
+	image := b.volumeImage(volumeID)
+	meta := &nvmetVolumeMeta{}
+	if err := readMeta(strings.TrimSuffix(image, imageSuffix)+metaSuffix, meta); err == nil && meta.DiscardOnDelete {
+		// blocks the image shares with snapshots or clones through reflinks are kept for them
+		if err := discardImage(image); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("discard volume %s: %v", volumeID, err)
+		}
+		klog.Infof("nvmet backend: discarded volume %s", volumeID)
+	}
+	for _, file := range []string{image, strings.TrimSuffix(image, imageSuffix) + metaSuffix} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %v", file, err)
+		}
+	}
+	klog.Infof("nvmet backend: deleted volume %s", volumeID)
+	return nil
+}
+
+func (b *nvmetBackend) GetVolume(volumeID string) (*BackendVolume, error) {
+	if err := validateBackendID(volumeID); err != nil {
+		return nil, &NotFoundError{Kind: "volume", ID: volumeID}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.getVolume(volumeID)
+}
+
+func (b *nvmetBackend) getVolume(volumeID string) (*BackendVolume, error) {
+	image := b.volumeImage(volumeID)
+	info, err := os.Stat(image)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &NotFoundError{Kind: "volume", ID: volumeID}
+		}
+		return nil, err
+	}
+	meta := &nvmetVolumeMeta{}
+	if err := readMeta(strings.TrimSuffix(image, imageSuffix)+metaSuffix, meta); err != nil {
+		if os.IsNotExist(err) {
+			// image without metadata is a leftover of an interrupted create
+			return nil, &NotFoundError{Kind: "volume", ID: volumeID}
+		}
+		return nil, err
+	}
+
+	vol := &BackendVolume{
+		ID:                volumeID,
+		SizeBytes:         info.Size(),
+		Nqn:               b.nqn(volumeID),
+		DeviceUUID:        meta.DeviceUUID,
+		SourceSnapshotID:  meta.SourceSnapshotID,
+		SourceVolumeID:    meta.SourceVolumeID,
+		CopyIncomplete:    meta.CopyIncomplete,
+		MutableParameters: meta.MutableParameters,
+		PublishedNodes:    meta.PublishedNodes,
+		Encrypted:         meta.Encrypted,
+		Condition:         b.exportCondition(volumeID),
+	}
+	// export always allows any host, a subsystem restricted to allowed_hosts by an admin is not shared
+	allowAnyHost, _ := readSysfsAttr(filepath.Join(NVMET_CONFIGFS, "subsystems", vol.Nqn, "attr_allow_any_host"))
+	vol.Shared = allowAnyHost == "1"
+	if vol.TargetAddr, err = readSysfsAttr(filepath.Join(b.portDir(), "addr_traddr")); err != nil {
+		return nil, fmt.Errorf("read nvmet port address: %v", err)
+	}
+	if vol.TargetPort, err = readSysfsAttr(filepath.Join(b.portDir(), "addr_trsvcid")); err != nil {
+		return nil, fmt.Errorf("read nvmet port service id: %v", err)
+	}
+	if vol.Transport, err = readSysfsAttr(filepath.Join(b.portDir(), "addr_trtype")); err != nil {
+		return nil, fmt.Errorf("read nvmet port transport: %v", err)
+	}
+	return vol, nil
+}
+
+// ModifyVolume only records the parameters: the kernel target has no per-namespace QoS, I/O limits,
+// queue tuning and connect options are applied by the nodes, which get the parameters in the publish context.
+func (b *nvmetBackend) ModifyVolume(volumeID string, params map[string]string) error {
+	if err := validateBackendID(volumeID); err != nil {
+		return &NotFoundError{Kind: "volume", ID: volumeID}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	metaFile := filepath.Join(b.volumesDir(), volumeID+metaSuffix)
+	meta := &nvmetVolumeMeta{}
+	if err := readMeta(metaFile, meta); err != nil {
+		if os.IsNotExist(err) {
+			return &NotFoundError{Kind: "volume", ID: volumeID}
+		}
+		return err
+	}
+	if _, err := os.Stat(b.volumeImage(volumeID)); os.IsNotExist(err) {
+		return &NotFoundError{Kind: "volume", ID: volumeID}
+	}
+	meta.MutableParameters = mutableParameters(params)
+	if err := writeMeta(metaFile, meta); err != nil {
+		return err
+	}
+	klog.Infof("nvmet backend: modified volume %s to %v", volumeID, meta.MutableParameters)
+	return nil
+}
+
+// ExpandVolume grows the image and has the target revalidate the namespace size, which notifies
+// connected hosts with a namespace attribute changed event so they pick up the new size.
+func (b *nvmetBackend) ExpandVolume(volumeID string, sizeBytes int64) (*BackendVolume, error) {
+	if err := validateBackendID(volumeID); err != nil {
+		return nil, &NotFoundError{Kind: "volume", ID: volumeID}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	vol, err := b.getVolume(volumeID)
+	if err != nil {
+		return nil, err
+	}
+	if vol.SizeBytes >= sizeBytes {
+		return vol, nil
+	}
+	if err := growImage(b.volumeImage(volumeID), sizeBytes); err != nil {
+		return nil, err
+	}
+
+	// revalidate_size only exists since Linux 5.13, older targets report the new size on the next identify
+	revalidate := filepath.Join(NVMET_CONFIGFS, "subsystems", vol.Nqn, "namespaces", nvmetNamespaceID, "revalidate_size")
+	if _, err := os.Stat(revalidate); err == nil {
+		if err := writeConfigfsAttr(revalidate, "1"); err != nil {
+			return nil, err
+		}
+	}
+	klog.Infof("nvmet backend: expanded volume %s from %d to %d bytes", volumeID, vol.SizeBytes, sizeBytes)
+	return b.getVolume(volumeID)
+}
+
+func (b *nvmetBackend) ListVolumes() ([]*BackendVolume, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(b.volumesDir(), "*"+metaSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var volumes []*BackendVolume
+	for _, file := range files {
+		vol, err := b.getVolume(strings.TrimSuffix(filepath.Base(file), metaSuffix))
+		if err != nil {
+			klog.Warningf("nvmet backend: skip volume %s: %v", file, err)
+			continue
+		}
+		volumes = append(volumes, vol)
+	}
+	return volumes, nil
+}
+
+// PublishVolume only records the node: subsystems allow any host, so there is nothing to grant.
+func (b *nvmetBackend) PublishVolume(volumeID, nodeID string) error {
+	return b.updatePublishedNodes(volumeID, func(nodes []string) []string {
+		for _, node := range nodes {
+			if node == nodeID {
+				return nodes
+			}
+		}
+		nodes = append(nodes, nodeID)
+		sort.Strings(nodes)
+		return nodes
+	})
+}
+
+func (b *nvmetBackend) UnpublishVolume(volumeID, nodeID string) error {
+	return b.updatePublishedNodes(volumeID, func(nodes []string) []string {
+		var kept []string
+		for _, node := range nodes {
+			if node != nodeID {
+				kept = append(kept, node)
+			}
+		}
+		return kept
+	})
+}
+
+func (b *nvmetBackend) updatePublishedNodes(volumeID string, update func([]string) []string) error {
+	if err := validateBackendID(volumeID); err != nil {
+		return &NotFoundError{Kind: "volume", ID: volumeID}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, err := b.getVolume(volumeID); err != nil {
+		return err
+	}
+	metaFile := filepath.Join(b.volumesDir(), volumeID+metaSuffix)
+	meta := &nvmetVolumeMeta{}
+	if err := readMeta(metaFile, meta); err != nil {
+		return err
+	}
+	meta.PublishedNodes = update(meta.PublishedNodes)
+	return writeMeta(metaFile, meta)
+}
+
+// exportCondition checks that the namespace of the volume is enabled on the image and reachable through the port.
+func (b *nvmetBackend) exportCondition(volumeID string) BackendVolumeCondition {
+	nqn := b.nqn(volumeID)
+	nsDir := filepath.Join(NVMET_CONFIGFS, "subsystems", nqn, "namespaces", nvmetNamespaceID)
+
+	if enabled, err := readSysfsAttr(filepath.Join(nsDir, "enable")); err != nil || enabled != "1" {
+		return BackendVolumeCondition{Abnormal: true, Message: fmt.Sprintf("namespace of subsystem %s is not enabled", nqn)}
+	}
+	if devicePath, err := readSysfsAttr(filepath.Join(nsDir, "device_path")); err != nil || devicePath != b.volumeImage(volumeID) {
+		return BackendVolumeCondition{Abnormal: true, Message: fmt.Sprintf("namespace of subsystem %s is not backed by %s", nqn, b.volumeImage(volumeID))}
+	}
+	if _, err := os.Lstat(filepath.Join(b.portDir(), "subsystems", nqn)); err != nil {
+		return BackendVolumeCondition{Abnormal: true, Message: fmt.Sprintf("subsystem %s is not exported on port %s", nqn, b.port)}
+	}
+	return BackendVolumeCondition{Message: fmt.Sprintf("namespace of subsystem %s is exported on port %s", nqn, b.port)}
+}
+
+// GetCapacity reports the free space of the data directory. Images are sparse, so this is what
+// volumes can still be filled with rather than a hard limit on their declared sizes. Every volume is
+// placed in the data directory, none of the parameters changes where it goes.
+func (b *nvmetBackend) GetCapacity(params map[string]string) (int64, error) {
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(b.volumesDir(), &statfs); err != nil {
+		return 0, fmt.Errorf("statfs %s: %v", b.volumesDir(), err)
+	}
+	return int64(statfs.Bavail) * int64(statfs.Bsize), nil
+}
+
+func (b *nvmetBackend) CreateSnapshot(name, sourceVolumeID string) (*BackendSnapshot, error) {
+	if err := validateBackendID(name); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if snap, err := b.getSnapshot(name); err == nil {
+		if snap.SourceVolumeID != sourceVolumeID {
+			return nil, &AlreadyExistsError{Kind: "snapshot", ID: name, Reason: "of volume " + snap.SourceVolumeID}
+		}
+		return snap, nil
+	}
+	src, err := b.getVolume(sourceVolumeID)
+	if err != nil {
+		return nil, err
+	}
+	if src.CopyIncomplete {
+		return nil, fmt.Errorf("volume %s is an incomplete copy", sourceVolumeID)
+	}
+
+	image := b.snapshotImage(name)
+	metaFile := strings.TrimSuffix(image, imageSuffix) + metaSuffix
+	// only a reflink is atomic, a copy of a volume in use would not be a point-in-time snapshot
+	if err := cloneFile(b.volumeImage(sourceVolumeID), image, false); err != nil {
+		return nil, fmt.Errorf("snapshot volume %s: %v", sourceVolumeID, err)
+	}
+	meta := &nvmetSnapshotMeta{SourceVolumeID: sourceVolumeID, CreationTime: time.Now().UTC(), Encrypted: src.Encrypted}
+	if err := writeMeta(metaFile, meta); err != nil {
+		os.Remove(image)
+		return nil, err
+	}
+	klog.Infof("nvmet backend: created snapshot %s of volume %s", name, sourceVolumeID)
+	return b.getSnapshot(name)
+}
+
+func (b *nvmetBackend) DeleteSnapshot(snapshotID string) error {
+	if err := validateBackendID(snapshotID); err != nil {
+		klog.V(4).Infof("nvmet backend: delete snapshot: %v", err)
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	image := b.snapshotImage(snapshotID)
+	for _, file := range []string{strings.TrimSuffix(image, imageSuffix) + metaSuffix, image} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %v", file, err)
+		}
+	}
+	klog.Infof("nvmet backend: deleted snapshot %s", snapshotID)
+	return nil
+}
+
+func (b *nvmetBackend) GetSnapshot(snapshotID string) (*BackendSnapshot, error) {
+	if err := validateBackendID(snapshotID); err != nil {
+		return nil, &NotFoundError{Kind: "snapshot", ID: snapshotID}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.getSnapshot(snapshotID)
+}
+
+func (b *nvmetBackend) getSnapshot(snapshotID string) (*BackendSnapshot, error) {
+	image := b.snapshotImage(snapshotID)
+	info, err := os.Stat(image)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, &NotFoundError{Kind: "snapshot", ID: snapshotID}
+		}
+		return nil, err
+	}
+	meta := &nvmetSnapshotMeta{}
+	if err := readMeta(strings.TrimSuffix(image, imageSuffix)+metaSuffix, meta); err != nil {
+		if os.IsNotExist(err) {
+			return nil, &NotFoundError{Kind: "snapshot", ID: snapshotID}
+		}
+		return nil, err
+	}
+
+	return &BackendSnapshot{
+		ID:             snapshotID,
+		SourceVolumeID: meta.SourceVolumeID,
+		SizeBytes:      info.Size(),
+		CreationTime:   meta.CreationTime,
+		ReadyToUse:     true,
+		Encrypted:      meta.Encrypted,
+	}, nil
+}
+
+func (b *nvmetBackend) ListSnapshots() ([]*BackendSnapshot, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(b.snapshotsDir(), "*"+metaSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var snapshots []*BackendSnapshot
+	for _, file := range files {
+		snap, err := b.getSnapshot(strings.TrimSuffix(filepath.Base(file), metaSuffix))
+		if err != nil {
+			klog.Warningf("nvmet backend: skip snapshot %s: %v", file, err)
+			continue
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
+
+// export creates the subsystem and namespace of the volume in configfs and links it to the port.
+// Every step is skipped when already done, so export can be repeated.
+func (b *nvmetBackend) export(vol *BackendVolume) error {
+	subsysDir := filepath.Join(NVMET_CONFIGFS, "subsystems", vol.Nqn)
+	nsDir := filepath.Join(subsysDir, "namespaces", nvmetNamespaceID)
+
+	if err := os.Mkdir(subsysDir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("create subsystem %s: %v", vol.Nqn, err)
+	}
+	if err := writeConfigfsAttr(filepath.Join(subsysDir, "attr_allow_any_host"), "1"); err != nil {
+		return err
+	}
+	if err := os.Mkdir(nsDir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("create namespace of subsystem %s: %v", vol.Nqn, err)
+	}
+	if enabled, _ := readSysfsAttr(filepath.Join(nsDir, "enable")); enabled != "1" {
+		if err := writeConfigfsAttr(filepath.Join(nsDir, "device_path"), b.volumeImage(vol.ID)); err != nil {
+			return err
+		}
+		if err := writeConfigfsAttr(filepath.Join(nsDir, "device_uuid"), vol.DeviceUUID); err != nil {
+			return err
+		}
+		if err := writeConfigfsAttr(filepath.Join(nsDir, "enable"), "1"); err != nil {
+			return err
+		}
+	}
+
+	portLink := filepath.Join(b.portDir(), "subsystems", vol.Nqn)
+	if err := os.Symlink(subsysDir, portLink); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("link subsystem %s to port %s: %v", vol.Nqn, b.port, err)
+	}
+	return nil
+}
+
+// unexport reverts export, ignoring the steps that are already undone.
+func (b *nvmetBackend) unexport(volumeID string) error {
+	nqn := b.nqn(volumeID)
+	subsysDir := filepath.Join(NVMET_CONFIGFS, "subsystems", nqn)
+	nsDir := filepath.Join(subsysDir, "namespaces", nvmetNamespaceID)
+
+	if err := os.Remove(filepath.Join(b.portDir(), "subsystems", nqn)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unlink subsystem %s from port %s: %v", nqn, b.port, err)
+	}
+	if _, err := os.Stat(nsDir); err == nil {
+		if err := writeConfigfsAttr(filepath.Join(nsDir, "enable"), "0"); err != nil {
+			return err
+		}
+		if err := os.Remove(nsDir); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove namespace of subsystem %s: %v", nqn, err)
+		}
+	}
+	if err := os.Remove(subsysDir); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove subsystem %s: %v", nqn, err)
+	}
+	return nil
+}
+
+func writeConfigfsAttr(path, value string) error {
+	if err := os.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("write %q to %s: %v", value, path, err)
+	}
+	return nil
+}
+
+func writeMeta(path string, meta interface{}) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return fmt.Errorf("write %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func readMeta(path string, meta interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, meta)
+}
+
+// growImage extends image to sizeBytes, it never shrinks it
+func growImage(image string, sizeBytes int64) error {
+	info, err := os.Stat(image)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && info.Size() >= sizeBytes {
+		return nil
+	}
+	file, err := os.OpenFile(image, os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("open image %s: %v", image, err)
+	}
+	defer file.Close()
+	if err := file.Truncate(sizeBytes); err != nil {
+		return fmt.Errorf("resize image %s to %d bytes: %v", image, sizeBytes, err)
+	}
+	return nil
+}
+
+// cloneFile creates dst as a reflink of src. When allowCopy is set and the filesystem cannot reflink,
+// it falls back to a sparse copy.
+func cloneFile(src, dst string, allowCopy bool) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	cloneErr := unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if cloneErr == nil {
+		return nil
+	}
+	if !allowCopy {
+		return fmt.Errorf("reflink %s to %s: %w", src, dst, cloneErr)
+	}
+	klog.Infof("Reflink %s to %s not possible (%v), copying", src, dst, cloneErr)
+	return sparseCopy(in, out)
+}
+
+// isReflinkUnsupported reports whether a cloneFile error means the filesystem cannot reflink the file
+func isReflinkUnsupported(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EINVAL)
+}
+
+// sparseCopy copies in to out, seeking over all-zero chunks instead of writing them.
+func sparseCopy(in io.Reader, out *os.File) error {
+	buf := make([]byte, copyChunkSize)
+	zero := make([]byte, copyChunkSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := out.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// a trailing hole is only materialized by setting the size
+	return out.Truncate(size)
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID
+func newUUID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", fmt.Errorf("generate uuid: %v", err)
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func newTestNvmetBackend(t *testing.T) *nvmetBackend {
+	b := &nvmetBackend{dataDir: t.TempDir(), port: "test", nqnPrefix: "nqn.2022-08.com.nvmf.csi.test"}
+	for _, dir := range []string{b.volumesDir(), b.snapshotsDir()} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b
+}
+
+func TestNvmetDeleteMissing(t *testing.T) {
+	b := newTestNvmetBackend(t)
+	for _, id := range []string{"../etc", "", "pvc-unknown"} {
+		if err := b.DeleteVolume(id); err != nil {
+			t.Errorf("DeleteVolume(%q) error: %v", id, err)
+		}
+		if err := b.DeleteSnapshot(id); err != nil {
+			t.Errorf("DeleteSnapshot(%q) error: %v", id, err)
+		}
+	}
+}
+
+func TestNvmetCheckVolumeParams(t *testing.T) {
+	b := newTestNvmetBackend(t)
+	meta := &nvmetVolumeMeta{DeviceUUID: "uuid", Encrypted: true, DiscardOnDelete: true}
+	if err := writeMeta(filepath.Join(b.volumesDir(), "pvc-1"+metaSuffix), meta); err != nil {
+		t.Fatal(err)
+	}
+	vol := &BackendVolume{ID: "pvc-1", Encrypted: true}
+
+	tests := []struct {
+		name      string
+		params    map[string]string
+		encrypted bool
+		wantErr   bool
+	}{
+		{"same", map[string]string{discardOnDeleteKey: "true"}, true, false},
+		{"not encrypted", map[string]string{discardOnDeleteKey: "true"}, false, true},
+		{"no discard", map[string]string{}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := b.checkVolumeParams(vol, tt.params, tt.encrypted)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("checkVolumeParams() error: %v", err)
+				}
+				return
+			}
+			var exists *AlreadyExistsError
+			if !errors.As(err, &exists) {
+				t.Errorf("checkVolumeParams() = %v, want *AlreadyExistsError", err)
+			}
+		})
+	}
+}
+
+func TestNvmetModifyVolume(t *testing.T) {
+	b := newTestNvmetBackend(t)
+	var notFound *NotFoundError
+	if err := b.ModifyVolume("pvc-1", map[string]string{readIOPSKey: "100"}); !errors.As(err, &notFound) {
+		t.Fatalf("ModifyVolume() of a missing volume = %v, want *NotFoundError", err)
+	}
+
+	if err := os.WriteFile(b.volumeImage("pvc-1"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	metaFile := filepath.Join(b.volumesDir(), "pvc-1"+metaSuffix)
+	if err := writeMeta(metaFile, &nvmetVolumeMeta{DeviceUUID: "uuid", PublishedNodes: []string{"node-1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ModifyVolume("pvc-1", map[string]string{readIOPSKey: "100", writeIOPSKey: "50"}); err != nil {
+		t.Fatalf("ModifyVolume() error: %v", err)
+	}
+	if err := b.ModifyVolume("pvc-1", map[string]string{readIOPSKey: "200"}); err != nil {
+		t.Fatalf("ModifyVolume() error: %v", err)
+	}
+
+	meta := &nvmetVolumeMeta{}
+	if err := readMeta(metaFile, meta); err != nil {
+		t.Fatal(err)
+	}
+	// the parameters of a class replace those of the class before, writeIOPS is no longer set
+	if want := map[string]string{readIOPSKey: "200"}; !reflect.DeepEqual(meta.MutableParameters, want) {
+		t.Errorf("recorded parameters = %v, want %v", meta.MutableParameters, want)
+	}
+	if meta.DeviceUUID != "uuid" || len(meta.PublishedNodes) != 1 {
+		t.Errorf("ModifyVolume() lost metadata: %+v", meta)
+	}
+}
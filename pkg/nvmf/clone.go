@@ -0,0 +1,130 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"k8s.io/klog/v2"
+)
+
+// cloneVolume creates volume name as a copy of sourceVolumeID, natively when the backend supports it
+// and otherwise by creating an empty volume and copying the source blocks over NVMe-oF from this host.
+// The block copy is not atomic, so like a native copy without reflinks it is refused while the source is
+// published, and the volume stays marked incomplete until all blocks are copied, for a retry to redo it.
+func cloneVolume(backend Backend, name, sourceVolumeID string, sizeBytes int64, params map[string]string) (*BackendVolume, error) {
+	src, err := backend.GetVolume(sourceVolumeID)
+	if err != nil {
+		return nil, err
+	}
+	if src.CopyIncomplete {
+		return nil, fmt.Errorf("source volume %s is an incomplete copy", sourceVolumeID)
+	}
+	if sizeBytes < src.SizeBytes {
+		sizeBytes = src.SizeBytes
+	}
+
+	vol, err := backend.CloneVolume(name, sourceVolumeID, sizeBytes, params)
+	var unsupported *UnsupportedError
+	if !errors.As(err, &unsupported) {
+		return vol, err
+	}
+	klog.Infof("Clone volume %s from %s: %v, falling back to block copy", name, sourceVolumeID, err)
+	if len(src.PublishedNodes) > 0 {
+		return nil, &InUseError{Kind: "volume", ID: sourceVolumeID,
+			Reason: fmt.Sprintf("published to %v, a block copy would not be consistent", src.PublishedNodes)}
+	}
+
+	// the copy carries the source's LUKS container, if any
+	copyParams := make(map[string]string, len(params)+1)
+	for key, value := range params {
+		copyParams[key] = value
+	}
+	copyParams[encryptionKey] = strconv.FormatBool(src.Encrypted)
+	vol, err = backend.CreateVolumeForCopy(name, sourceVolumeID, sizeBytes, copyParams)
+	if err != nil {
+		return nil, err
+	}
+	if !vol.CopyIncomplete {
+		return vol, nil
+	}
+	if err := blockCopyVolume(src, vol); err != nil {
+		if derr := backend.DeleteVolume(vol.ID); derr != nil {
+			klog.Errorf("Clone volume %s: delete incomplete copy error: %v", name, derr)
+		}
+		return nil, err
+	}
+	if err := backend.CompleteVolumeCopy(vol.ID); err != nil {
+		return nil, fmt.Errorf("mark copy of volume %s complete: %v", vol.ID, err)
+	}
+	vol.CopyIncomplete = false
+	return vol, nil
+}
+
+// blockCopyVolume connects both volumes to this host and copies every block of src to dst.
+func blockCopyVolume(src, dst *BackendVolume) error {
+	srcConnector := backendVolumeConnector(src)
+	srcPath, err := srcConnector.Connect()
+	if err != nil {
+		return fmt.Errorf("connect source volume %s: %v", src.ID, err)
+	}
+	defer srcConnector.Disconnect()
+
+	dstConnector := backendVolumeConnector(dst)
+	dstPath, err := dstConnector.Connect()
+	if err != nil {
+		return fmt.Errorf("connect volume %s: %v", dst.ID, err)
+	}
+	defer dstConnector.Disconnect()
+
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dstPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	klog.Infof("Block copy volume %s (%s) to %s (%s)", src.ID, srcPath, dst.ID, dstPath)
+	copied, err := io.CopyBuffer(out, in, make([]byte, copyChunkSize))
+	if err != nil {
+		return fmt.Errorf("copy volume %s to %s: %v", src.ID, dst.ID, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("flush volume %s: %v", dst.ID, err)
+	}
+	klog.Infof("Block copy volume %s to %s done, %d bytes", src.ID, dst.ID, copied)
+	return nil
+}
+
+func backendVolumeConnector(vol *BackendVolume) *Connector {
+	return getNvmfConnector(&nvmfDiskInfo{
+		VolName:   vol.ID,
+		Nqn:       vol.Nqn,
+		Addr:      vol.TargetAddr,
+		Port:      vol.TargetPort,
+		DeviceID:  "uuid." + vol.DeviceUUID,
+		Transport: vol.Transport,
+	})
+}
@@ -15,10 +15,14 @@ limitations under the License.
 */
 package nvmf
 
+import "time"
+
 const (
-	NVMF_NQN_SIZE = 223
-	SYS_NVMF      = "/sys/class/nvme"
-	RUN_NVMF      = "/run/nvmf"
+	NVMF_NQN_SIZE   = 223
+	SYS_NVMF        = "/sys/class/nvme"
+	SYS_NVME_SUBSYS = "/sys/class/nvme-subsystem"
+	SYS_BLOCK       = "/sys/block"
+	RUN_NVMF        = "/run/nvmf"
 )
 
 // Here erron
@@ -31,17 +35,27 @@ const (
 	DefaultDriverName        = "csi.nvmf.com"
 	DefaultDriverServicePort = "12230"
 	DefaultDriverVersion     = "v1.0.0"
+	DefaultShutdownTimeout   = 25 * time.Second
+	DefaultHealthInterval    = 10 * time.Second
 
 	DefaultVolumeMapPath = "/var/lib/kubelet/plugins/csi.nvmf.com/volumes"
+	DefaultCgroupRoot    = "/sys/fs/cgroup"
 )
 
 type GlobalConfig struct {
 	NVMfVolumeMapDir   string
 	DriverName         string
 	Region             string
+	Zone               string
+	Fabrics            string // comma separated fabrics the node reaches, or the target is exported on
 	NodeID             string
 	Endpoint           string // CSI endpoint
 	Version            string
 	IsControllerServer bool
 	LogLevel           string
+	ShutdownTimeout    time.Duration // deadline for draining in-flight operations on SIGTERM/SIGINT
+	HealthInterval     time.Duration // interval between controller health checks, 0 disables them
+	CgroupRoot         string        // mount point of the cgroup v2 hierarchy holding pod cgroups
+	TrimInterval       time.Duration // interval between fstrim runs on mounted volumes, 0 only trims on request
+	Backend            BackendConfig // provisioning backend of the controller service
 }
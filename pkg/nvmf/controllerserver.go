@@ -17,60 +17,526 @@ limitations under the License.
 package nvmf
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"k8s.io/klog/v2"
 )
 
+const (
+	DefaultVolumeSize int64 = 1 << 30
+)
+
+// StorageClass parameters handed to the node in the volume context of provisioned volumes
+var nodeParameterKeys = append(append(append([]string{reservationKey, reservationPreemptKey, pvcNameContextKey, pvcNamespaceContextKey},
+	ioLimitKeys...), queueSettingKeys...), connectOptionKeys...)
+
+// prefix of the parameters the external-provisioner reserves for itself, such as the fstype and secret references
+const provisionerParameterPrefix = "csi.storage.k8s.io/"
+
+// validateParameterKeys rejects parameters the driver does not know. Volumes all land in the one place the
+// backend serves, so an unknown parameter, e.g. one meant to pick a pool, must not be silently ignored.
+func validateParameterKeys(params map[string]string) error {
+	known := map[string]bool{encryptionKey: true, discardOnDeleteKey: true}
+	for _, key := range append(filesystemParameterKeys(params), nodeParameterKeys...) {
+		known[key] = true
+	}
+	for key := range params {
+		if !known[key] && !strings.HasPrefix(key, provisionerParameterPrefix) {
+			return fmt.Errorf("unknown parameter %q", key)
+		}
+	}
+	return nil
+}
+
 type ControllerServer struct {
+	csi.UnimplementedControllerServer
+
 	Driver *driver
+
+	mu          sync.Mutex
+	volumeLocks map[string]bool
 }
 
 // create controller server
 func NewControllerServer(d *driver) *ControllerServer {
 	return &ControllerServer{
-		Driver: d,
+		Driver:      d,
+		volumeLocks: make(map[string]bool),
 	}
 }
 
-// You should realize your volume provider here, such as requesting the Cloud to create an NVMf block and
+// lockVolume serializes operations on a volume, it returns false when another one is in progress.
+func (c *ControllerServer) lockVolume(volumeID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.volumeLocks[volumeID] {
+		return false
+	}
+	c.volumeLocks[volumeID] = true
+	return true
+}
+
+func (c *ControllerServer) unlockVolume(volumeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.volumeLocks, volumeID)
+}
+
+// CreateVolume provisions a namespace through the configured backend. Without a backend,
+// you should realize your volume provider here, such as requesting the Cloud to create an NVMf block and
 // returning specific information to you
 func (c *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "CreateVolume should implement by yourself. ")
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "CreateVolume should implement by yourself. ")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return nil, err
+	}
+
+	// Pre-check
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume missing Name in req.")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume missing VolumeCapabilities in req.")
+	}
+	for _, capability := range req.GetVolumeCapabilities() {
+		if msg := c.Driver.validateVolumeCapability(capability, nil); msg != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %s", msg)
+		}
+	}
+
+	if err := validateParameterKeys(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+	if _, _, err := reservationRequested(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+	if _, err := encryptionRequested(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+	if _, err := parseIOLimits(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+	if _, err := parseQueueSettings(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+	if err := validateFilesystemParameters(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+	if _, err := discardOnDeleteRequested(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+	// the parameters of the VolumeAttributesClass the claim is created with
+	if err := validateMutableParameters(req.GetMutableParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: %v", err)
+	}
+
+	size := req.GetCapacityRange().GetRequiredBytes()
+	if size == 0 {
+		size = DefaultVolumeSize
+	}
+	limit := req.GetCapacityRange().GetLimitBytes()
+	if limit > 0 && size > limit {
+		return nil, status.Errorf(codes.OutOfRange, "CreateVolume: required bytes %d exceed limit bytes %d", size, limit)
+	}
+
+	if !c.lockVolume(req.GetName()) {
+		return nil, status.Errorf(codes.Aborted, "CreateVolume: an operation on volume %s is already in progress", req.GetName())
+	}
+	defer c.unlockVolume(req.GetName())
+	source := req.GetVolumeContentSource()
+	// a block copy of the source must not race with a publish of it
+	if source.GetVolume() != nil {
+		sourceID := source.GetVolume().GetVolumeId()
+		if !c.lockVolume(sourceID) {
+			return nil, status.Errorf(codes.Aborted, "CreateVolume: an operation on source volume %s is already in progress", sourceID)
+		}
+		defer c.unlockVolume(sourceID)
+	}
+
+	// a copy is at least as large as its source, which must fit the limit before anything is created
+	var sourceSize int64
+	switch {
+	case source.GetSnapshot() != nil:
+		snap, err := c.Driver.backend.GetSnapshot(source.GetSnapshot().GetSnapshotId())
+		if err != nil {
+			return nil, backendError("CreateVolume", err)
+		}
+		sourceSize = snap.SizeBytes
+	case source.GetVolume() != nil:
+		src, err := c.Driver.backend.GetVolume(source.GetVolume().GetVolumeId())
+		if err != nil {
+			return nil, backendError("CreateVolume", err)
+		}
+		sourceSize = src.SizeBytes
+	}
+	if limit > 0 && sourceSize > limit {
+		return nil, status.Errorf(codes.OutOfRange, "CreateVolume: content source size %d exceeds limit bytes %d", sourceSize, limit)
+	}
+
+	// the target must be reachable from where the volume is requested
+	accessible := c.Driver.targetTopologies()
+	if c.Driver.hasTopology() {
+		accessible = reachableTopologies(accessible, req.GetAccessibilityRequirements())
+		if len(accessible) == 0 {
+			return nil, status.Errorf(codes.ResourceExhausted, "CreateVolume: no target reachable from requested topology %v", req.GetAccessibilityRequirements())
+		}
+	}
+
+	var vol *BackendVolume
+	var err error
+	switch {
+	case source == nil:
+		vol, err = c.Driver.backend.CreateVolume(req.GetName(), size, req.GetParameters())
+	case source.GetSnapshot() != nil:
+		vol, err = c.Driver.backend.CreateVolumeFromSnapshot(req.GetName(), source.GetSnapshot().GetSnapshotId(), size, req.GetParameters())
+	case source.GetVolume() != nil:
+		vol, err = cloneVolume(c.Driver.backend, req.GetName(), source.GetVolume().GetVolumeId(), size, req.GetParameters())
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume: unsupported volume content source %v", source)
+	}
+	if err != nil {
+		klog.Errorf("CreateVolume: create volume %s error: %v", req.GetName(), err)
+		return nil, backendError("CreateVolume", err)
+	}
+	if limit > 0 && vol.SizeBytes > limit {
+		return nil, status.Errorf(codes.OutOfRange, "CreateVolume: volume %s size %d exceeds limit bytes %d", vol.ID, vol.SizeBytes, limit)
+	}
+	if len(req.GetMutableParameters()) > 0 {
+		if err := c.Driver.backend.ModifyVolume(vol.ID, req.GetMutableParameters()); err != nil {
+			return nil, backendError("CreateVolume", err)
+		}
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           vol.ID,
+			CapacityBytes:      vol.SizeBytes,
+			VolumeContext:      volumeContext(vol, req.GetParameters()),
+			ContentSource:      source,
+			AccessibleTopology: accessible,
+		},
+	}, nil
 }
 
 func (c *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "DeleteVolume should implement by yourself. ")
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "DeleteVolume should implement by yourself. ")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "DeleteVolume missing VolumeID in req.")
+	}
+	if !c.lockVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "DeleteVolume: an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer c.unlockVolume(req.GetVolumeId())
+
+	if err := c.Driver.backend.DeleteVolume(req.GetVolumeId()); err != nil {
+		klog.Errorf("DeleteVolume: delete volume %s error: %v", req.GetVolumeId(), err)
+		return nil, backendError("DeleteVolume", err)
+	}
+	return &csi.DeleteVolumeResponse{}, nil
 }
 
 func (c *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ControllerExpandVolume should implement by yourself")
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "ControllerExpandVolume should implement by yourself")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume missing VolumeID in req.")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume missing CapacityRange in req.")
+	}
+	if !c.lockVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "ControllerExpandVolume: an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer c.unlockVolume(req.GetVolumeId())
+
+	size := req.GetCapacityRange().GetRequiredBytes()
+	limit := req.GetCapacityRange().GetLimitBytes()
+	if limit > 0 && size > limit {
+		return nil, status.Errorf(codes.OutOfRange, "ControllerExpandVolume: required bytes %d exceed limit bytes %d", size, limit)
+	}
+
+	vol, err := c.Driver.backend.ExpandVolume(req.GetVolumeId(), size)
+	if err != nil {
+		klog.Errorf("ControllerExpandVolume: expand volume %s to %d bytes error: %v", req.GetVolumeId(), size, err)
+		return nil, backendError("ControllerExpandVolume", err)
+	}
+	if limit > 0 && vol.SizeBytes > limit {
+		return nil, status.Errorf(codes.OutOfRange, "ControllerExpandVolume: volume %s size %d exceeds limit bytes %d", vol.ID, vol.SizeBytes, limit)
+	}
+
+	// block devices pick up the new namespace size from the target, filesystems and dm-crypt mappings
+	// have to be grown on the node
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         vol.SizeBytes,
+		NodeExpansionRequired: req.GetVolumeCapability().GetBlock() == nil || vol.Encrypted,
+	}, nil
 }
 
-func (c *ControllerServer) ControllerGetVolume(ctx context.Context, request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ControllerGetVolume not implement")
+// ControllerModifyVolume records the new mutable parameters of a volume in the backend. Nodes apply them on
+// the next publish, through the publish context, or when they reconcile the VolumeAttributesClass of the claim.
+func (c *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "ControllerModifyVolume not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_MODIFY_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerModifyVolume missing VolumeID in req.")
+	}
+	if err := validateMutableParameters(req.GetMutableParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerModifyVolume: %v", err)
+	}
+	if !c.lockVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "ControllerModifyVolume: an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer c.unlockVolume(req.GetVolumeId())
+
+	if err := c.Driver.backend.ModifyVolume(req.GetVolumeId(), req.GetMutableParameters()); err != nil {
+		klog.Errorf("ControllerModifyVolume: modify volume %s error: %v", req.GetVolumeId(), err)
+		return nil, backendError("ControllerModifyVolume", err)
+	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+func (c *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "ControllerGetVolume not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume missing VolumeID in req.")
+	}
+
+	vol, err := c.Driver.backend.GetVolume(req.GetVolumeId())
+	if err != nil {
+		return nil, backendError("ControllerGetVolume", err)
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: c.csiVolume(vol),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: vol.PublishedNodes,
+			VolumeCondition:  csiVolumeCondition(vol),
+		},
+	}, nil
 }
 
+// ControllerPublishVolume records the node a backend volume is attached to, so that ListVolumes and
+// ControllerGetVolume can report it. The node connects to the target itself in NodeStageVolume.
 func (c *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ControllerPublishVolume not implement")
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "ControllerPublishVolume not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume missing VolumeID in req.")
+	}
+	if len(req.GetNodeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume missing NodeID in req.")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume missing VolumeCapability in req.")
+	}
+	// the check of the nodes the volume is published to and the publish itself must not interleave with others
+	if !c.lockVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "ControllerPublishVolume: an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer c.unlockVolume(req.GetVolumeId())
+
+	vol, err := c.Driver.backend.GetVolume(req.GetVolumeId())
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) && req.GetVolumeContext()["targetTrAddr"] != "" {
+		// statically provisioned volumes carry their target in the volume context and are unknown to the backend
+		klog.V(4).Infof("ControllerPublishVolume: volume %s is not managed by the backend, publish untracked", req.GetVolumeId())
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	if err != nil {
+		return nil, backendError("ControllerPublishVolume", err)
+	}
+	if msg := c.Driver.validateVolumeCapability(req.GetVolumeCapability(), vol); msg != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerPublishVolume: %s", msg)
+	}
+	if !isMultiNodeAccessMode(req.GetVolumeCapability().GetAccessMode().GetMode()) {
+		for _, node := range vol.PublishedNodes {
+			if node != req.GetNodeId() {
+				return nil, status.Errorf(codes.FailedPrecondition, "ControllerPublishVolume: volume %s is already published to node %s", vol.ID, node)
+			}
+		}
+	}
+
+	if err := c.Driver.backend.PublishVolume(req.GetVolumeId(), req.GetNodeId()); err != nil {
+		klog.Errorf("ControllerPublishVolume: publish volume %s to node %s error: %v", req.GetVolumeId(), req.GetNodeId(), err)
+		return nil, backendError("ControllerPublishVolume", err)
+	}
+	// nodes apply the parameters the volume was modified to on top of its volume context
+	return &csi.ControllerPublishVolumeResponse{PublishContext: vol.MutableParameters}, nil
 }
 
-func (c *ControllerServer) ControllerUnpublishVolume(ctx context.Context, request *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ControllerUnpublishVolume not implement")
+func (c *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "ControllerUnpublishVolume not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume missing VolumeID in req.")
+	}
+	if !c.lockVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "ControllerUnpublishVolume: an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer c.unlockVolume(req.GetVolumeId())
+
+	// without a node ID the volume is unpublished from every node
+	nodes := []string{req.GetNodeId()}
+	if req.GetNodeId() == "" {
+		vol, err := c.Driver.backend.GetVolume(req.GetVolumeId())
+		if err == nil {
+			nodes = vol.PublishedNodes
+		}
+	}
+	for _, node := range nodes {
+		err := c.Driver.backend.UnpublishVolume(req.GetVolumeId(), node)
+		var notFound *NotFoundError
+		if err != nil && !errors.As(err, &notFound) {
+			klog.Errorf("ControllerUnpublishVolume: unpublish volume %s from node %s error: %v", req.GetVolumeId(), node, err)
+			return nil, backendError("ControllerUnpublishVolume", err)
+		}
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (c *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, request *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ValidateVolumeCapabilities not implement")
+// ValidateVolumeCapabilities checks the capabilities against the driver's access modes and, for backend volumes,
+// against the namespace. Unsupported capabilities are reported in the response message rather than as an error.
+func (c *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities missing VolumeID in req.")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities missing VolumeCapabilities in req.")
+	}
+
+	// volumes unknown to the driver are statically provisioned and only checked against the driver
+	var vol *BackendVolume
+	if c.Driver.backend != nil {
+		var err error
+		vol, err = c.Driver.backend.GetVolume(req.GetVolumeId())
+		var notFound *NotFoundError
+		if errors.As(err, &notFound) && req.GetVolumeContext()["targetTrAddr"] != "" {
+			klog.V(4).Infof("ValidateVolumeCapabilities: volume %s is not managed by the backend", req.GetVolumeId())
+			vol, err = nil, nil
+		}
+		if err != nil {
+			return nil, backendError("ValidateVolumeCapabilities", err)
+		}
+	}
+
+	for _, capability := range req.GetVolumeCapabilities() {
+		if msg := c.Driver.validateVolumeCapability(capability, vol); msg != "" {
+			klog.V(4).Infof("ValidateVolumeCapabilities: volume %s: %s", req.GetVolumeId(), msg)
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: msg}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
 }
 
-func (c *ControllerServer) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ListVolumes not implement")
+func (c *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "ListVolumes not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return nil, err
+	}
+
+	volumes, err := c.Driver.backend.ListVolumes()
+	if err != nil {
+		return nil, backendError("ListVolumes", err)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].ID < volumes[j].ID
+	})
+
+	start, end, next, err := paginate(len(volumes), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, vol := range volumes[start:end] {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: c.csiVolume(vol),
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: vol.PublishedNodes,
+				VolumeCondition:  csiVolumeCondition(vol),
+			},
+		})
+	}
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: next,
+	}, nil
 }
 
-func (c *ControllerServer) GetCapacity(ctx context.Context, request *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "GetCapacity not implement")
+func (c *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "GetCapacity not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_CAPACITY); err != nil {
+		return nil, err
+	}
+
+	if err := validateParameterKeys(req.GetParameters()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "GetCapacity: %v", err)
+	}
+
+	// nothing is available in a topology segment the target is not reachable from
+	if req.GetAccessibleTopology() != nil && c.Driver.hasTopology() {
+		requirement := &csi.TopologyRequirement{Requisite: []*csi.Topology{req.GetAccessibleTopology()}}
+		if len(reachableTopologies(c.Driver.targetTopologies(), requirement)) == 0 {
+			return &csi.GetCapacityResponse{AvailableCapacity: 0}, nil
+		}
+	}
+
+	available, err := c.Driver.backend.GetCapacity(req.GetParameters())
+	if err != nil {
+		klog.Errorf("GetCapacity: error: %v", err)
+		return nil, backendError("GetCapacity", err)
+	}
+	// images are sparse, a volume may be declared larger than the space left, so no maximum size is reported
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
 }
 
 func (c *ControllerServer) ControllerGetCapabilities(ctx context.Context, request *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -81,14 +547,176 @@ func (c *ControllerServer) ControllerGetCapabilities(ctx context.Context, reques
 	}, nil
 }
 
-func (c *ControllerServer) CreateSnapshot(ctx context.Context, request *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "CreateSnapshot not implement")
+func (c *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "CreateSnapshot not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		return nil, err
+	}
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot missing Name in req.")
+	}
+	if len(req.GetSourceVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot missing SourceVolumeId in req.")
+	}
+
+	snap, err := c.Driver.backend.CreateSnapshot(req.GetName(), req.GetSourceVolumeId())
+	if err != nil {
+		klog.Errorf("CreateSnapshot: snapshot %s of volume %s error: %v", req.GetName(), req.GetSourceVolumeId(), err)
+		return nil, backendError("CreateSnapshot", err)
+	}
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(snap)}, nil
+}
+
+func (c *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "DeleteSnapshot not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		return nil, err
+	}
+	if len(req.GetSnapshotId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot missing SnapshotId in req.")
+	}
+
+	if err := c.Driver.backend.DeleteSnapshot(req.GetSnapshotId()); err != nil {
+		klog.Errorf("DeleteSnapshot: delete snapshot %s error: %v", req.GetSnapshotId(), err)
+		return nil, backendError("DeleteSnapshot", err)
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (c *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if c.Driver.backend == nil {
+		return nil, status.Errorf(codes.Unimplemented, "ListSnapshots not implement")
+	}
+	if err := c.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		return nil, err
+	}
+
+	var snapshots []*BackendSnapshot
+	if req.GetSnapshotId() != "" {
+		snap, err := c.Driver.backend.GetSnapshot(req.GetSnapshotId())
+		if err != nil {
+			var notFound *NotFoundError
+			if errors.As(err, &notFound) {
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			return nil, backendError("ListSnapshots", err)
+		}
+		snapshots = append(snapshots, snap)
+	} else {
+		all, err := c.Driver.backend.ListSnapshots()
+		if err != nil {
+			return nil, backendError("ListSnapshots", err)
+		}
+		snapshots = all
+	}
+
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snap := range snapshots {
+		if req.GetSourceVolumeId() != "" && snap.SourceVolumeID != req.GetSourceVolumeId() {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(snap)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Snapshot.SnapshotId < entries[j].Snapshot.SnapshotId
+	})
+
+	start, end, next, err := paginate(len(entries), req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: next,
+	}, nil
+}
+
+func (c *ControllerServer) csiVolume(vol *BackendVolume) *csi.Volume {
+	var source *csi.VolumeContentSource
+	switch {
+	case vol.SourceSnapshotID != "":
+		source = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: vol.SourceSnapshotID},
+		}}
+	case vol.SourceVolumeID != "":
+		source = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+			Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: vol.SourceVolumeID},
+		}}
+	}
+	return &csi.Volume{
+		VolumeId:           vol.ID,
+		CapacityBytes:      vol.SizeBytes,
+		VolumeContext:      vol.VolumeContext(),
+		ContentSource:      source,
+		AccessibleTopology: c.Driver.targetTopologies(),
+	}
 }
 
-func (c *ControllerServer) DeleteSnapshot(ctx context.Context, request *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "DeleteSnapshot not implement")
+// volumeContext returns the backend's connection details together with the parameters the node acts on.
+func volumeContext(vol *BackendVolume, params map[string]string) map[string]string {
+	ctx := vol.VolumeContext()
+	for _, key := range append(filesystemParameterKeys(params), nodeParameterKeys...) {
+		if value, ok := params[key]; ok {
+			ctx[key] = value
+		}
+	}
+	return ctx
 }
 
-func (c *ControllerServer) ListSnapshots(ctx context.Context, request *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ListSnapshots not implement")
+func csiVolumeCondition(vol *BackendVolume) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: vol.Condition.Abnormal,
+		Message:  vol.Condition.Message,
+	}
+}
+
+func csiSnapshot(snap *BackendSnapshot) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snap.ID,
+		SourceVolumeId: snap.SourceVolumeID,
+		SizeBytes:      snap.SizeBytes,
+		CreationTime:   timestamppb.New(snap.CreationTime),
+		ReadyToUse:     snap.ReadyToUse,
+	}
+}
+
+// paginate returns the range of entries for a list page and the token of the next page.
+// Tokens are the decimal index of the first entry of the page.
+func paginate(total int, startingToken string, maxEntries int32) (start, end int, next string, err error) {
+	if maxEntries < 0 {
+		return 0, 0, "", status.Errorf(codes.InvalidArgument, "invalid max entries %d", maxEntries)
+	}
+	if startingToken != "" {
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token %q", startingToken)
+		}
+	}
+	end = total
+	if maxEntries > 0 && start+int(maxEntries) < total {
+		end = start + int(maxEntries)
+		next = strconv.Itoa(end)
+	}
+	return start, end, next, nil
+}
+
+// backendError maps backend errors to gRPC status errors
+func backendError(method string, err error) error {
+	var notFound *NotFoundError
+	var exists *AlreadyExistsError
+	var inUse *InUseError
+	switch {
+	case errors.As(err, &notFound):
+		return status.Errorf(codes.NotFound, "%s: %v", method, err)
+	case errors.As(err, &exists):
+		return status.Errorf(codes.AlreadyExists, "%s: %v", method, err)
+	case errors.As(err, &inUse):
+		return status.Errorf(codes.FailedPrecondition, "%s: %v", method, err)
+	default:
+		return status.Errorf(codes.Internal, "%s: %v", method, err)
+	}
 }
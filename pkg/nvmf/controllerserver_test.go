@@ -0,0 +1,106 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateParameterKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{
+			name: "known",
+			params: map[string]string{
+				encryptionKey: "true", discardOnDeleteKey: "true", readIOPSKey: "100", "scheduler": "none",
+				"mkfsOptions.ext4": "-L data", fsckPolicyKey: "auto", reservationKey: "true",
+			},
+		},
+		{"provisioner", map[string]string{"csi.storage.k8s.io/fstype": "xfs", "csi.storage.k8s.io/pvc/name": "data"}, false},
+		{"placement", map[string]string{"pool": "fast"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateParameterKeys(tt.params); (err != nil) != tt.wantErr {
+				t.Errorf("validateParameterKeys() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestControllerVolumeLock(t *testing.T) {
+	d := &driver{backend: newTestNvmetBackend(t)}
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	})
+	cs := NewControllerServer(d)
+
+	if !cs.lockVolume("pvc-1") {
+		t.Fatal("lockVolume() of a free volume failed")
+	}
+	if cs.lockVolume("pvc-1") {
+		t.Fatal("lockVolume() of a locked volume succeeded")
+	}
+	_, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-1",
+		VolumeCapability: &csi.VolumeCapability{},
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("ControllerPublishVolume() of a locked volume = %v, want Aborted", err)
+	}
+
+	cs.unlockVolume("pvc-1")
+	if !cs.lockVolume("pvc-1") {
+		t.Error("lockVolume() after unlockVolume() failed")
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	d := &driver{backend: newTestNvmetBackend(t)}
+	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+	})
+	cs := NewControllerServer(d)
+
+	tests := []struct {
+		name     string
+		req      *csi.ControllerModifyVolumeRequest
+		wantCode codes.Code
+	}{
+		{"missing ID", &csi.ControllerModifyVolumeRequest{}, codes.InvalidArgument},
+		{"immutable", &csi.ControllerModifyVolumeRequest{VolumeId: "pvc-1", MutableParameters: map[string]string{discardOnDeleteKey: "true"}}, codes.InvalidArgument},
+		{"missing volume", &csi.ControllerModifyVolumeRequest{VolumeId: "pvc-1", MutableParameters: map[string]string{readIOPSKey: "100"}}, codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := cs.ControllerModifyVolume(context.Background(), tt.req); status.Code(err) != tt.wantCode {
+				t.Errorf("ControllerModifyVolume() = %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -17,6 +17,10 @@ limitations under the License.
 package nvmf
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -29,21 +33,41 @@ type driver struct {
 	version string
 
 	region       string
+	zone         string
+	fabrics      []string
 	volumeMapDir string
 
 	idServer         *IdentityServer
 	nodeServer       *NodeServer
 	controllerServer *ControllerServer
+	server           NonBlockingGRPCServer
+	backend          Backend
+	monitor          *healthMonitor
+	recorder         EventRecorder
+	trimmer          *trimmer
+	reconciler       *attributesReconciler
+	trimMetrics      *trimMetrics
+	throttler        *cgroupIOThrottler
 
 	cap   []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
 }
 
 // NewDriver create the identity/node
-func NewDriver(conf *GlobalConfig) *driver {
+func NewDriver(conf *GlobalConfig) (*driver, error) {
 	if conf.DriverName == "" {
-		klog.Fatalf("driverName not been specified")
-		return nil
+		return nil, fmt.Errorf("driverName not been specified")
+	}
+
+	fabrics, err := parseFabrics(conf.Fabrics)
+	if err != nil {
+		return nil, err
+	}
+
+	// the controller provisions volumes through the backend, nodes only inline volumes
+	backend, err := NewBackend(&conf.Backend)
+	if err != nil {
+		return nil, err
 	}
 
 	klog.Infof("Driver: %v version: %v", conf.DriverName, conf.Version)
@@ -52,26 +76,93 @@ func NewDriver(conf *GlobalConfig) *driver {
 		version:      conf.Version,
 		nodeId:       conf.NodeID,
 		region:       conf.Region,
+		zone:         conf.Zone,
+		fabrics:      fabrics,
 		volumeMapDir: conf.NVMfVolumeMapDir,
-	}
+		server:       NewNonBlockingGRPCServer(),
+		backend:      backend,
+		trimMetrics:  newTrimMetrics(),
+	}, nil
 }
 
-func (d *driver) Run(conf *GlobalConfig) {
-	d.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{})
+// Run serves the CSI services on conf.Endpoint and blocks until the server stops.
+func (d *driver) Run(conf *GlobalConfig) error {
+	var cscaps []csi.ControllerServiceCapability_RPC_Type
+	if conf.IsControllerServer && d.backend != nil {
+		cscaps = append(cscaps,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+		)
+	}
+	cscaps = append(cscaps, csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER)
+	d.AddControllerServiceCapabilities(cscaps)
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
 	})
 
 	d.idServer = NewIdentityServer(d)
+	d.throttler = newCgroupIOThrottler(conf.CgroupRoot)
+	d.recorder = NewEventRecorder(d.name, d.nodeId)
+	// the monitor reapplies volume settings on namespace uevents, so the listener starts first
+	startUeventWatcher()
+	d.monitor = newHealthMonitor(d.recorder, conf.HealthInterval, d.throttler)
+	go d.monitor.Run()
 	d.nodeServer = NewNodeServer(d)
+	d.trimmer = newTrimmer(d.nodeServer, conf.TrimInterval, d.recorder, d.trimMetrics)
+	if conf.TrimInterval > 0 || d.trimmer.kube != nil {
+		go d.trimmer.Run()
+	}
+	d.reconciler = newAttributesReconciler(d.nodeServer, d.recorder)
+	if d.reconciler.kube != nil {
+		go d.reconciler.Run()
+	}
 	if conf.IsControllerServer {
 		d.controllerServer = NewControllerServer(d)
 	}
 
 	klog.Infof("Starting csi-plugin Driver: %v", d.name)
-	s := NewNonBlockingGRPCServer()
-	s.Start(conf.Endpoint, d.idServer, d.controllerServer, d.nodeServer)
-	s.Wait()
+	if err := d.server.Start(conf.Endpoint, d.idServer, d.controllerServer, d.nodeServer); err != nil {
+		return err
+	}
+	return d.server.Wait()
+}
+
+// MetricsHandler serves the driver's metrics in the Prometheus text format.
+func (d *driver) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := d.trimMetrics.WriteTo(w); err != nil {
+		klog.Errorf("Metrics: write response error: %v", err)
+	}
+}
+
+// Stop drains in-flight operations and stops the CSI services, forcefully once ctx is done.
+func (d *driver) Stop(ctx context.Context) error {
+	klog.Infof("Stopping csi-plugin Driver: %v", d.name)
+	if d.monitor != nil {
+		d.monitor.Stop()
+	}
+	if d.trimmer != nil {
+		d.trimmer.Stop()
+	}
+	if d.reconciler != nil {
+		d.reconciler.Stop()
+	}
+	stopUeventWatcher()
+	return d.server.Shutdown(ctx)
 }
 
 func (d *driver) AddVolumeCapabilityAccessModes(caps []csi.VolumeCapability_AccessMode_Mode) []*csi.VolumeCapability_AccessMode {
@@ -84,6 +175,62 @@ func (d *driver) AddVolumeCapabilityAccessModes(caps []csi.VolumeCapability_Acce
 	return cap
 }
 
+// validateVolumeCapability returns why the capability cannot be provided for vol, or "" when it can.
+// vol may be nil for volumes that are not managed by the backend.
+func (d *driver) validateVolumeCapability(capability *csi.VolumeCapability, vol *BackendVolume) string {
+	if capability.GetBlock() == nil && capability.GetMount() == nil {
+		return "access type must be block or mount"
+	}
+
+	mode := capability.GetAccessMode().GetMode()
+	supported := false
+	for _, c := range d.cap {
+		if c.GetMode() == mode {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Sprintf("access mode %s is not supported by the driver", mode)
+	}
+	// nodes would corrupt a filesystem they all mount read-write, only clustered applications on raw block coordinate
+	if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER && capability.GetMount() != nil {
+		return fmt.Sprintf("access mode %s is only supported with block access type", mode)
+	}
+
+	if mount := capability.GetMount(); mount != nil {
+		if _, err := buildMountOptions(false, mount.GetMountFlags()); err != nil {
+			return err.Error()
+		}
+	}
+
+	if vol == nil {
+		return ""
+	}
+	if isMultiNodeAccessMode(mode) && !vol.Shared {
+		return fmt.Sprintf("access mode %s needs a shared namespace, but volume %s may only be connected by one host", mode, vol.ID)
+	}
+	if !isReadOnlyAccessMode(mode) && vol.ReadOnly {
+		return fmt.Sprintf("access mode %s needs write access, but volume %s is read-only", mode, vol.ID)
+	}
+	return ""
+}
+
+func isMultiNodeAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
+
+func isReadOnlyAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
 func (d *driver) AddControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_Type) {
 	var csc []*csi.ControllerServiceCapability
 
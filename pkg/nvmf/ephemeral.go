@@ -0,0 +1,142 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// set by kubelet in the volume context of CSI inline volumes
+	ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+	// volume attribute of inline volumes requesting their size
+	ephemeralSizeKey = "size"
+)
+
+var sizeSuffixes = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"K", 1000}, {"M", 1000 * 1000}, {"G", 1000 * 1000 * 1000}, {"T", 1000 * 1000 * 1000 * 1000},
+}
+
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralContextKey] == "true"
+}
+
+// parseSize parses a size in bytes with an optional binary (Ki, Mi, Gi, Ti) or decimal (K, M, G, T) suffix.
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	number := size
+	for _, s := range sizeSuffixes {
+		if strings.HasSuffix(size, s.suffix) {
+			number, multiplier = strings.TrimSuffix(size, s.suffix), s.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 || n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
+
+// ephemeralParameters returns the volume attributes of an inline volume that are StorageClass parameters,
+// without its size and the pod and volume information kubelet adds.
+func ephemeralParameters(volumeContext map[string]string) map[string]string {
+	params := make(map[string]string, len(volumeContext))
+	for key, value := range volumeContext {
+		if key != ephemeralSizeKey && !strings.HasPrefix(key, provisionerParameterPrefix) {
+			params[key] = value
+		}
+	}
+	return params
+}
+
+// provisionEphemeral creates the namespace of an inline volume through the backend and returns the request
+// with the volume context of the new namespace, so that it is published like any other volume.
+// created is false when the namespace already existed, e.g. when kubelet retries a publish.
+func (n *NodeServer) provisionEphemeral(req *csi.NodePublishVolumeRequest) (published *csi.NodePublishVolumeRequest, created bool, err error) {
+	if n.Driver.backend == nil {
+		return nil, false, fmt.Errorf("inline volumes need a provisioning backend on the node, see --backend")
+	}
+
+	size := DefaultVolumeSize
+	if value, ok := req.GetVolumeContext()[ephemeralSizeKey]; ok {
+		if size, err = parseSize(value); err != nil {
+			return nil, false, err
+		}
+	}
+	// the pod's volume attributes are checked like the parameters of a StorageClass
+	params := ephemeralParameters(req.GetVolumeContext())
+	if err := validateParameterKeys(params); err != nil {
+		return nil, false, err
+	}
+	if err := validateFilesystemParameters(params); err != nil {
+		return nil, false, err
+	}
+
+	var notFound *NotFoundError
+	_, err = n.Driver.backend.GetVolume(req.GetVolumeId())
+	if err != nil && !errors.As(err, &notFound) {
+		return nil, false, fmt.Errorf("get inline volume: %v", err)
+	}
+	created = err != nil
+	vol, err := n.Driver.backend.CreateVolume(req.GetVolumeId(), size, params)
+	if err != nil {
+		return nil, false, fmt.Errorf("create inline volume: %v", err)
+	}
+	if created {
+		klog.Infof("Provisioned inline volume %s of %d bytes as %s", vol.ID, vol.SizeBytes, vol.Nqn)
+	}
+
+	published = &csi.NodePublishVolumeRequest{
+		VolumeId:          req.GetVolumeId(),
+		PublishContext:    req.GetPublishContext(),
+		StagingTargetPath: req.GetStagingTargetPath(),
+		TargetPath:        req.GetTargetPath(),
+		VolumeCapability:  req.GetVolumeCapability(),
+		Readonly:          req.GetReadonly(),
+		Secrets:           req.GetSecrets(),
+		VolumeContext:     vol.VolumeContext(),
+	}
+	for key, value := range req.GetVolumeContext() {
+		if _, ok := published.VolumeContext[key]; !ok {
+			published.VolumeContext[key] = value
+		}
+	}
+	return published, created, nil
+}
+
+// deprovisionEphemeral deletes the namespace of an inline volume once it is unpublished.
+func (n *NodeServer) deprovisionEphemeral(volumeID string) error {
+	if n.Driver.backend == nil {
+		return fmt.Errorf("inline volume %s cannot be deleted without a provisioning backend", volumeID)
+	}
+	if err := n.Driver.backend.DeleteVolume(volumeID); err != nil {
+		return err
+	}
+	klog.Infof("Deleted inline volume %s", volumeID)
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestEphemeralParameters(t *testing.T) {
+	volumeContext := map[string]string{
+		ephemeralContextKey:                "true",
+		ephemeralSizeKey:                   "1Gi",
+		"csi.storage.k8s.io/pod.name":      "app",
+		"csi.storage.k8s.io/pod.namespace": "default",
+		readIOPSKey:                        "100",
+		fsckPolicyKey:                      "auto",
+	}
+	want := map[string]string{readIOPSKey: "100", fsckPolicyKey: "auto"}
+	if got := ephemeralParameters(volumeContext); !reflect.DeepEqual(got, want) {
+		t.Errorf("ephemeralParameters() = %v, want %v", got, want)
+	}
+}
+
+func TestProvisionEphemeralValidatesAttributes(t *testing.T) {
+	n := NewNodeServer(&driver{backend: newTestNvmetBackend(t)})
+	tests := []struct {
+		name       string
+		attributes map[string]string
+	}{
+		{"unknown", map[string]string{"pool": "fast"}},
+		{"mkfs options", map[string]string{"mkfsOptions.ext4": " "}},
+		{"fsck policy", map[string]string{fsckPolicyKey: "sometimes"}},
+		{"size", map[string]string{ephemeralSizeKey: "large"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volumeContext := map[string]string{ephemeralContextKey: "true"}
+			for key, value := range tt.attributes {
+				volumeContext[key] = value
+			}
+			req := &csi.NodePublishVolumeRequest{VolumeId: "csi-inline", VolumeContext: volumeContext}
+			if _, _, err := n.provisionEphemeral(req); err == nil {
+				t.Errorf("provisionEphemeral() accepted volume attributes %v", tt.attributes)
+			}
+		})
+	}
+}
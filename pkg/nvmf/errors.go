@@ -34,3 +34,41 @@ type UnsupportedHostnqnError struct {
 func (e *UnsupportedHostnqnError) Error() string {
 	return fmt.Sprintf("unsupported hostnqn sysfs file: target=%s", e.Target)
 }
+
+type NotFoundError struct {
+	Kind string
+	ID   string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Kind, e.ID)
+}
+
+type AlreadyExistsError struct {
+	Kind   string
+	ID     string
+	Reason string
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return fmt.Sprintf("%s %s already exists: %s", e.Kind, e.ID, e.Reason)
+}
+
+type UnsupportedError struct {
+	Operation string
+	Reason    string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("%s not supported: %s", e.Operation, e.Reason)
+}
+
+type InUseError struct {
+	Kind   string
+	ID     string
+	Reason string
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("%s %s is in use: %s", e.Kind, e.ID, e.Reason)
+}
@@ -0,0 +1,383 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	EventTypeNormal  = "Normal"
+	EventTypeWarning = "Warning"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// like client-go's event correlator, a repeated event within eventDedupWindow increments the count of
+	// the one posted before, and an object gets eventBurst events at once, then one every eventRefillInterval
+	eventDedupWindow    = 10 * time.Minute
+	eventBurst          = 25
+	eventRefillInterval = 5 * time.Minute
+	// bound on the posted events and objects remembered
+	eventCacheSize = 4096
+)
+
+// ObjectReference identifies the Kubernetes object an event is recorded on.
+type ObjectReference struct {
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	UID        string `json:"uid,omitempty"`
+	APIVersion string `json:"apiVersion"`
+}
+
+// EventRecorder records Kubernetes events on behalf of the driver.
+type EventRecorder interface {
+	Eventf(ref *ObjectReference, eventType, reason, messageFmt string, args ...interface{})
+}
+
+// NewEventRecorder returns a recorder posting events to the API server when running in a cluster,
+// and a recorder that only logs them otherwise.
+func NewEventRecorder(component, host string) EventRecorder {
+	recorder, err := newAPIEventRecorder(component, host)
+	if err != nil {
+		klog.Warningf("Kubernetes events are disabled, only logging them: %v", err)
+		return &logEventRecorder{}
+	}
+	return recorder
+}
+
+type logEventRecorder struct{}
+
+func (r *logEventRecorder) Eventf(ref *ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	klog.Infof("Event(%s %s/%s): type: %s reason: %s %s", ref.Kind, ref.Namespace, ref.Name, eventType, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// kubeClient calls the API server with the in-cluster service account credentials.
+type kubeClient struct {
+	apiServer string
+	tokenPath string
+	client    *http.Client
+}
+
+// apiEventRecorder posts core/v1 events through the API server, counting repeats and rate limiting them
+// per object so that a flapping path does not flood the API server.
+type apiEventRecorder struct {
+	component string
+	host      string
+	kube      *kubeClient
+	now       func() time.Time
+
+	mu      sync.Mutex
+	posted  map[string]*postedEvent
+	buckets map[string]*eventBucket
+}
+
+// postedEvent is an event already created on the API server, updated when it repeats.
+type postedEvent struct {
+	name      string
+	namespace string
+	first     string
+	count     int32
+	lastSeen  time.Time
+}
+
+// eventBucket is the token bucket limiting the events of one object.
+type eventBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type eventSource struct {
+	Component string `json:"component,omitempty"`
+	Host      string `json:"host,omitempty"`
+}
+
+type eventMeta struct {
+	GenerateName string `json:"generateName"`
+	Namespace    string `json:"namespace"`
+}
+
+type event struct {
+	Metadata           eventMeta       `json:"metadata"`
+	InvolvedObject     ObjectReference `json:"involvedObject"`
+	Reason             string          `json:"reason"`
+	Message            string          `json:"message"`
+	Type               string          `json:"type"`
+	Source             eventSource     `json:"source"`
+	FirstTimestamp     string          `json:"firstTimestamp"`
+	LastTimestamp      string          `json:"lastTimestamp"`
+	Count              int32           `json:"count"`
+	ReportingComponent string          `json:"reportingComponent"`
+	ReportingInstance  string          `json:"reportingInstance"`
+}
+
+func newAPIEventRecorder(component, host string) (*apiEventRecorder, error) {
+	kube, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	return newAPIEventRecorderWithClient(component, host, kube), nil
+}
+
+func newAPIEventRecorderWithClient(component, host string, kube *kubeClient) *apiEventRecorder {
+	return &apiEventRecorder{
+		component: component,
+		host:      host,
+		kube:      kube,
+		now:       time.Now,
+		posted:    make(map[string]*postedEvent),
+		buckets:   make(map[string]*eventBucket),
+	}
+}
+
+func newKubeClient() (*kubeClient, error) {
+	apiHost, apiPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if apiHost == "" || apiPort == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster")
+	}
+
+	tokenPath := filepath.Join(serviceAccountDir, "token")
+	if _, err := os.Stat(tokenPath); err != nil {
+		return nil, fmt.Errorf("stat service account token: %v", err)
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("read service account ca: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in service account ca")
+	}
+
+	return &kubeClient{
+		apiServer: "https://" + net.JoinHostPort(apiHost, apiPort),
+		tokenPath: tokenPath,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (r *apiEventRecorder) Eventf(ref *ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	klog.Infof("Event(%s %s/%s): type: %s reason: %s %s", ref.Kind, ref.Namespace, ref.Name, eventType, reason, message)
+
+	// events on cluster-scoped objects such as PersistentVolumes live in the default namespace
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	objectKey := strings.Join([]string{ref.Kind, namespace, ref.Name, ref.UID}, "/")
+	eventKey := strings.Join([]string{objectKey, eventType, reason, message}, "/")
+
+	r.mu.Lock()
+	now := r.now()
+	if !r.allow(objectKey, now) {
+		r.mu.Unlock()
+		klog.V(4).Infof("Event: too many events for %s/%s, dropping %s", ref.Kind, ref.Name, reason)
+		return
+	}
+	var repeated postedEvent
+	prev, ok := r.posted[eventKey]
+	if ok && now.Sub(prev.lastSeen) < eventDedupWindow {
+		prev.count++
+		prev.lastSeen = now
+		repeated = *prev
+	}
+	r.mu.Unlock()
+
+	timestamp := now.UTC().Format(time.RFC3339)
+	if repeated.name != "" {
+		err := r.patch(&repeated, timestamp)
+		if err == nil {
+			return
+		}
+		// the event may have expired, post it anew
+		klog.V(4).Infof("Event: update event %s for %s/%s error, posting it again: %v", reason, ref.Kind, ref.Name, err)
+	}
+
+	name, err := r.post(ref, namespace, eventType, reason, message, timestamp)
+	if err != nil {
+		klog.Errorf("Event: post event %s for %s/%s error: %v", reason, ref.Kind, ref.Name, err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.posted) >= eventCacheSize {
+		r.prune(now)
+	}
+	r.posted[eventKey] = &postedEvent{name: name, namespace: namespace, first: timestamp, count: 1, lastSeen: now}
+}
+
+// allow takes a token from the bucket of the object, it is called with r.mu held.
+func (r *apiEventRecorder) allow(objectKey string, now time.Time) bool {
+	b, ok := r.buckets[objectKey]
+	if !ok {
+		if len(r.buckets) >= eventCacheSize {
+			r.prune(now)
+		}
+		b = &eventBucket{tokens: eventBurst, last: now}
+		r.buckets[objectKey] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(eventRefillInterval)
+	if b.tokens > eventBurst {
+		b.tokens = eventBurst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets events past the dedup window and objects whose bucket has refilled, it is called with r.mu held.
+func (r *apiEventRecorder) prune(now time.Time) {
+	for key, e := range r.posted {
+		if now.Sub(e.lastSeen) >= eventDedupWindow {
+			delete(r.posted, key)
+		}
+	}
+	for key, b := range r.buckets {
+		if b.tokens+float64(now.Sub(b.last))/float64(eventRefillInterval) >= eventBurst {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+// post creates an event and returns its name.
+func (r *apiEventRecorder) post(ref *ObjectReference, namespace, eventType, reason, message, timestamp string) (string, error) {
+	body, err := json.Marshal(&event{
+		Metadata:           eventMeta{GenerateName: ref.Name + ".", Namespace: namespace},
+		InvolvedObject:     *ref,
+		Reason:             reason,
+		Message:            message,
+		Type:               eventType,
+		Source:             eventSource{Component: r.component, Host: r.host},
+		FirstTimestamp:     timestamp,
+		LastTimestamp:      timestamp,
+		Count:              1,
+		ReportingComponent: r.component,
+		ReportingInstance:  r.host,
+	})
+	if err != nil {
+		return "", fmt.Errorf("encode event: %v", err)
+	}
+
+	resp, err := r.kube.do(http.MethodPost, fmt.Sprintf("/api/v1/namespaces/%s/events", namespace), body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("post returned %s", resp.Status)
+	}
+	var created struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("decode created event: %v", err)
+	}
+	return created.Metadata.Name, nil
+}
+
+// patch updates the count and last timestamp of a repeated event.
+func (r *apiEventRecorder) patch(e *postedEvent, timestamp string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"count":          e.count,
+		"firstTimestamp": e.first,
+		"lastTimestamp":  timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := r.kube.do(http.MethodPatch, fmt.Sprintf("/api/v1/namespaces/%s/events/%s", e.namespace, e.name), body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("patch returned %s", resp.Status)
+	}
+	return nil
+}
+
+// do sends a request with an optional JSON body to path on the API server.
+func (k *kubeClient) do(method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, k.apiServer+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// projected service account tokens are rotated by kubelet, so read the current one every time
+	token, err := os.ReadFile(k.tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %v", err)
+	}
+	switch {
+	case method == http.MethodPatch:
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	case body != nil:
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return k.client.Do(req)
+}
+
+// get decodes the object at path on the API server into object.
+func (k *kubeClient) get(path string, object interface{}) error {
+	resp, err := k.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s returned %s", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(object); err != nil {
+		return fmt.Errorf("decode %s: %v", path, err)
+	}
+	return nil
+}
+
+// getAnnotations returns the annotations of a namespaced object, such as persistentvolumeclaims/<name>.
+func (k *kubeClient) getAnnotations(namespace, resource string) (map[string]string, error) {
+	var object struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := k.get(fmt.Sprintf("/api/v1/namespaces/%s/%s", namespace, resource), &object); err != nil {
+		return nil, err
+	}
+	return object.Metadata.Annotations, nil
+}
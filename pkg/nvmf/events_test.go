@@ -0,0 +1,133 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEventServer counts the events posted and the counts patched into them.
+type fakeEventServer struct {
+	mu      sync.Mutex
+	posts   int
+	counts  map[string]int32
+	missing bool
+}
+
+func (s *fakeEventServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPost:
+		s.posts++
+		name := fmt.Sprintf("event-%d", s.posts)
+		s.counts[name] = 1
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"metadata":{"name":%q}}`, name)
+	case http.MethodPatch:
+		name := filepath.Base(r.URL.Path)
+		if _, ok := s.counts[name]; !ok || s.missing {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var patch struct {
+			Count int32 `json:"count"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.counts[name] = patch.Count
+	}
+}
+
+func newTestEventRecorder(t *testing.T, s *fakeEventServer) (*apiEventRecorder, *time.Time) {
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := newAPIEventRecorderWithClient("csi.nvmf.com", "node-1", &kubeClient{apiServer: server.URL, tokenPath: tokenPath, client: server.Client()})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+	return r, &now
+}
+
+func TestEventRecorderCountsRepeats(t *testing.T) {
+	s := &fakeEventServer{counts: make(map[string]int32)}
+	r, now := newTestEventRecorder(t, s)
+	ref := &ObjectReference{Kind: "Pod", Namespace: "default", Name: "app", APIVersion: "v1"}
+
+	for i := 0; i < 3; i++ {
+		r.Eventf(ref, EventTypeWarning, "ControllerConnecting", "volume %s: reconnecting", "pvc-1")
+		*now = now.Add(time.Minute)
+	}
+	if s.posts != 1 || s.counts["event-1"] != 3 {
+		t.Errorf("posts = %d, counts = %v, want one event counted 3 times", s.posts, s.counts)
+	}
+
+	// another message is another event
+	r.Eventf(ref, EventTypeNormal, "ControllerLive", "volume %s: live", "pvc-1")
+	if s.posts != 2 {
+		t.Errorf("posts = %d, want 2", s.posts)
+	}
+
+	// past the window, or once the event is gone, a repeat is posted anew
+	*now = now.Add(eventDedupWindow)
+	r.Eventf(ref, EventTypeWarning, "ControllerConnecting", "volume %s: reconnecting", "pvc-1")
+	if s.posts != 3 {
+		t.Errorf("posts = %d after the dedup window, want 3", s.posts)
+	}
+	s.missing = true
+	r.Eventf(ref, EventTypeWarning, "ControllerConnecting", "volume %s: reconnecting", "pvc-1")
+	if s.posts != 4 {
+		t.Errorf("posts = %d after the event expired, want 4", s.posts)
+	}
+}
+
+func TestEventRecorderRateLimit(t *testing.T) {
+	s := &fakeEventServer{counts: make(map[string]int32)}
+	r, now := newTestEventRecorder(t, s)
+	ref := &ObjectReference{Kind: "Pod", Namespace: "default", Name: "app", APIVersion: "v1"}
+	other := &ObjectReference{Kind: "Pod", Namespace: "default", Name: "db", APIVersion: "v1"}
+
+	for i := 0; i < eventBurst+5; i++ {
+		r.Eventf(ref, EventTypeWarning, "PathInaccessible", "path %d is inaccessible", i)
+	}
+	if s.posts != eventBurst {
+		t.Errorf("posts = %d, want the burst of %d", s.posts, eventBurst)
+	}
+	r.Eventf(other, EventTypeWarning, "PathInaccessible", "path is inaccessible")
+	if s.posts != eventBurst+1 {
+		t.Errorf("another object was rate limited, posts = %d", s.posts)
+	}
+
+	*now = now.Add(eventRefillInterval)
+	r.Eventf(ref, EventTypeWarning, "PathInaccessible", "path is inaccessible again")
+	if s.posts != eventBurst+2 {
+		t.Errorf("posts = %d after a refill, want %d", s.posts, eventBurst+2)
+	}
+}
@@ -22,15 +22,56 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
 	"k8s.io/klog/v2"
 )
 
+// connectOption maps a volume context key to an option of the fabrics connect command. The kernel keeps
+// the options of a controller until it is removed, so changed values take effect on the next connect.
+type connectOption struct {
+	key    string
+	option string
+	// min and max bound the value, ctrl_loss_tmo -1 reconnects forever
+	min, max int64
+}
+
+var connectOptions = []connectOption{
+	{key: "ctrlLossTmo", option: "ctrl_loss_tmo", min: -1, max: 1<<31 - 1},
+	{key: "reconnectDelay", option: "reconnect_delay", min: 1, max: 1<<31 - 1},
+}
+
+var connectOptionKeys = func() []string {
+	var keys []string
+	for _, o := range connectOptions {
+		keys = append(keys, o.key)
+	}
+	return keys
+}()
+
+// parseConnectOptions returns the connect command options set in the volume context, e.g. ",ctrl_loss_tmo=60".
+func parseConnectOptions(volumeContext map[string]string) (string, error) {
+	var builder strings.Builder
+	for _, o := range connectOptions {
+		value, ok := volumeContext[o.key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < o.min || n > o.max {
+			return "", fmt.Errorf("invalid %s %q: must be an integer between %d and %d", o.key, value, o.min, o.max)
+		}
+		builder.WriteString(fmt.Sprintf(",%s=%d", o.option, n))
+	}
+	return builder.String(), nil
+}
+
 type Connector struct {
 	VolumeID      string
 	DeviceID      string
+	Nsid          string
 	TargetNqn     string
 	TargetAddr    string
 	TargetPort    string
@@ -39,6 +80,58 @@ type Connector struct {
 	HostId        string
 	RetryCount    int32
 	CheckInterval int32
+	// ConnectOptions are appended to the connect command, see parseConnectOptions
+	ConnectOptions string `json:",omitempty"`
+	// TargetPaths are the publish target paths sharing this connection
+	TargetPaths []string `json:",omitempty"`
+	// ReadOnlyPaths are the target paths published read-only
+	ReadOnlyPaths []string `json:",omitempty"`
+	// ReservationKey and ReservationType are set while this node holds a persistent reservation
+	ReservationKey  uint64 `json:",omitempty"`
+	ReservationType uint8  `json:",omitempty"`
+	// Ephemeral is set for inline volumes, which are deleted when unpublished
+	Ephemeral bool `json:",omitempty"`
+	// Encrypted is set when the namespace is published through a dm-crypt mapping
+	Encrypted bool `json:",omitempty"`
+	// IOLimits are set on the cgroups of the pods in PodCgroups, keyed by their target path
+	IOLimits   *ioLimits         `json:",omitempty"`
+	PodCgroups map[string]string `json:",omitempty"`
+	// QueueSettings tune the block queue of the namespace
+	QueueSettings []queueSetting `json:",omitempty"`
+	// PVCNamespace and PVCName identify the claim whose annotations request fstrim runs
+	PVCNamespace string `json:",omitempty"`
+	PVCName      string `json:",omitempty"`
+	// EventRef is the object events about the volume are recorded on, kept for after a restart
+	EventRef *ObjectReference `json:",omitempty"`
+	// MutableParameters are the parameters in effect that ControllerModifyVolume may change, ContextParameters
+	// the ones of the volume context, in effect for the keys its VolumeAttributesClass does not set
+	MutableParameters map[string]string `json:",omitempty"`
+	ContextParameters map[string]string `json:",omitempty"`
+}
+
+// clone returns a copy of the connector sharing no state with it.
+func (c *Connector) clone() *Connector {
+	cc := *c
+	cc.TargetPaths = append([]string(nil), c.TargetPaths...)
+	cc.ReadOnlyPaths = append([]string(nil), c.ReadOnlyPaths...)
+	cc.QueueSettings = append([]queueSetting(nil), c.QueueSettings...)
+	if c.IOLimits != nil {
+		limits := *c.IOLimits
+		cc.IOLimits = &limits
+	}
+	if c.PodCgroups != nil {
+		cc.PodCgroups = make(map[string]string, len(c.PodCgroups))
+		for targetPath, cgroupDir := range c.PodCgroups {
+			cc.PodCgroups[targetPath] = cgroupDir
+		}
+	}
+	cc.MutableParameters = mutableParameters(c.MutableParameters)
+	cc.ContextParameters = mutableParameters(c.ContextParameters)
+	if c.EventRef != nil {
+		ref := *c.EventRef
+		cc.EventRef = &ref
+	}
+	return &cc
 }
 
 func getNvmfConnector(nvmfInfo *nvmfDiskInfo) *Connector {
@@ -65,14 +158,16 @@ func getNvmfConnector(nvmfInfo *nvmfDiskInfo) *Connector {
 	}
 
 	return &Connector{
-		VolumeID:   nvmfInfo.VolName,
-		DeviceID:   nvmfInfo.DeviceID,
-		TargetNqn:  nvmfInfo.Nqn,
-		TargetAddr: nvmfInfo.Addr,
-		TargetPort: nvmfInfo.Port,
-		Transport:  nvmfInfo.Transport,
-		HostNqn:    hostnqn,
-		HostId:     hostid,
+		VolumeID:       nvmfInfo.VolName,
+		DeviceID:       nvmfInfo.DeviceID,
+		Nsid:           nvmfInfo.Nsid,
+		TargetNqn:      nvmfInfo.Nqn,
+		TargetAddr:     nvmfInfo.Addr,
+		TargetPort:     nvmfInfo.Port,
+		Transport:      nvmfInfo.Transport,
+		HostNqn:        hostnqn,
+		HostId:         hostid,
+		ConnectOptions: nvmfInfo.ConnectOptions,
 	}
 }
 
@@ -276,10 +371,15 @@ func (c *Connector) Connect() (string, error) {
 	if c.HostId != "" {
 		builder.WriteString(fmt.Sprintf(",hostid=%s", c.HostId))
 	}
+	builder.WriteString(c.ConnectOptions)
 	baseString := builder.String()
 
 	devicePath := strings.Join([]string{"/dev/disk/by-id/nvme-", c.DeviceID}, "")
 
+	// subscribe before connecting so the namespace add event cannot be missed
+	added, cancel := subscribeNvmeDevice(c.TargetNqn, c.DeviceID)
+	defer cancel()
+
 	// connect to nvmf disk
 	err := _connect(baseString)
 	if err != nil {
@@ -287,7 +387,8 @@ func (c *Connector) Connect() (string, error) {
 	}
 	klog.Infof("Connect Volume %s success nqn: %s, hostnqn: %s", c.VolumeID, c.TargetNqn, c.HostNqn)
 	retries := int(c.RetryCount / c.CheckInterval)
-	if exists, err := waitForPathToExist(devicePath, retries, int(c.CheckInterval), c.Transport); !exists {
+	devicePath, err = waitForDevice(c, devicePath, retries, int(c.CheckInterval), added)
+	if err != nil {
 		klog.Errorf("connect nqn %s error %v, rollback!!!", c.TargetNqn, err)
 		ret := disconnectByNqn(c.TargetNqn, c.HostNqn)
 		if ret < 0 {
@@ -295,6 +396,16 @@ func (c *Connector) Connect() (string, error) {
 		}
 		return "", err
 	}
+	if c.Nsid != "" {
+		if err := verifyNamespaceNsid(devicePath, c.Nsid); err != nil {
+			klog.Errorf("connect nqn %s error %v, rollback!!!", c.TargetNqn, err)
+			ret := disconnectByNqn(c.TargetNqn, c.HostNqn)
+			if ret < 0 {
+				klog.Errorf("rollback error !!!")
+			}
+			return "", err
+		}
+	}
 
 	// create nqn directory
 	nqnPath := filepath.Join(RUN_NVMF, c.TargetNqn)
@@ -336,6 +447,54 @@ func (c *Connector) Disconnect() error {
 	return nil
 }
 
+// connectVolume returns the connector and device of a volume, connecting it unless it is already connected
+// for other target paths on this node. connected reports whether this call made the connection.
+func connectVolume(nvmfInfo *nvmfDiskInfo, connectorFilePath string) (c *Connector, devicePath string, connected bool, err error) {
+	var targetPaths []string
+	if existing, err := GetConnectorFromFile(connectorFilePath); err == nil && len(existing.TargetPaths) > 0 {
+		devName, err := findNamespaceDevice(existing.TargetNqn, existing.DeviceID)
+		if err == nil {
+			return existing, filepath.Join("/dev", devName), false, nil
+		}
+		klog.Warningf("Volume %s is published to %v, but its namespace is gone, reconnecting: %v", existing.VolumeID, existing.TargetPaths, err)
+		targetPaths = existing.TargetPaths
+	}
+
+	c = getNvmfConnector(nvmfInfo)
+	devicePath, err = c.Connect()
+	if err != nil {
+		return nil, "", false, err
+	}
+	if devicePath == "" {
+		c.Disconnect()
+		return nil, "", false, fmt.Errorf("connected, but return nil devicePath")
+	}
+	c.TargetPaths = targetPaths
+	return c, devicePath, true, nil
+}
+
+func (c *Connector) addTargetPath(targetPath string) {
+	for _, p := range c.TargetPaths {
+		if p == targetPath {
+			return
+		}
+	}
+	c.TargetPaths = append(c.TargetPaths, targetPath)
+}
+
+// removeTargetPath forgets targetPath and reports whether other target paths still use the connection
+func (c *Connector) removeTargetPath(targetPath string) bool {
+	var kept []string
+	for _, p := range c.TargetPaths {
+		if p != targetPath {
+			kept = append(kept, p)
+		}
+	}
+	c.TargetPaths = kept
+	c.setTargetPathReadOnly(targetPath, false)
+	return len(kept) > 0
+}
+
 // PersistConnector persists the provided Connector to the specified file (ie /var/lib/pfile/myConnector.json)
 func persistConnectorFile(c *Connector, filePath string) error {
 	f, err := os.Create(filePath)
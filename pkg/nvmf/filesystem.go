@@ -0,0 +1,382 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+)
+
+const (
+	// volume context key prefix of the mkfs arguments for a filesystem type, e.g. mkfsOptions.ext4
+	mkfsOptionsKeyPrefix = "mkfsOptions."
+	// volume context key of the fsck policy applied before mounting a formatted filesystem
+	fsckPolicyKey = "fsckPolicy"
+
+	defaultFsType = "ext4"
+)
+
+type fsckPolicy string
+
+const (
+	// fsckNever mounts without checking
+	fsckNever fsckPolicy = "never"
+	// fsckAuto repairs filesystems mounted read-write when their state asks for it
+	fsckAuto fsckPolicy = "auto"
+	// fsckAlways forces a full check, repairing read-write and only checking read-only mounts
+	fsckAlways fsckPolicy = "always"
+)
+
+// fsck exit codes, see fsck(8)
+const (
+	fsckErrorsCorrected       = 1
+	fsckErrorsCorrectedReboot = 2
+	fsckErrorsUncorrected     = 4
+	fsckOperationalError      = 8
+)
+
+var fsTypeRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// SELinux mount options, kubelet passes context= with the SELinuxMount feature
+var seLinuxContextOptions = map[string]bool{"context": true, "fscontext": true, "defcontext": true, "rootcontext": true}
+
+// filesystems without ownership in their inodes, which take the group of all files as a mount option
+var mountGroupOptionFsTypes = map[string]bool{"vfat": true, "msdos": true, "exfat": true, "udf": true, "iso9660": true}
+
+// filesystemOptions control how AttachDisk formats and checks the filesystem of a mount volume.
+type filesystemOptions struct {
+	MkfsOptions []string
+	Fsck        fsckPolicy
+}
+
+// filesystemCorruptError reports a filesystem fsck found errors on that it did not repair.
+type filesystemCorruptError struct {
+	Device string
+	Output string
+}
+
+func (e *filesystemCorruptError) Error() string {
+	return fmt.Sprintf("filesystem on %s is corrupt and was not repaired by fsck: %s", e.Device, e.Output)
+}
+
+func parseFsckPolicy(volumeContext map[string]string) (fsckPolicy, error) {
+	value, ok := volumeContext[fsckPolicyKey]
+	if !ok {
+		return fsckAuto, nil
+	}
+	switch policy := fsckPolicy(value); policy {
+	case fsckNever, fsckAuto, fsckAlways:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid %s %q, must be %s, %s or %s", fsckPolicyKey, value, fsckNever, fsckAuto, fsckAlways)
+}
+
+// parseFilesystemOptions reads the mkfs arguments for fsType and the fsck policy from the volume context.
+// The arguments are split on white space, so values such as labels cannot contain any.
+func parseFilesystemOptions(volumeContext map[string]string, fsType string) (*filesystemOptions, error) {
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	policy, err := parseFsckPolicy(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	return &filesystemOptions{
+		MkfsOptions: strings.Fields(volumeContext[mkfsOptionsKeyPrefix+fsType]),
+		Fsck:        policy,
+	}, nil
+}
+
+// validateFilesystemParameters checks the mkfs and fsck parameters of a StorageClass.
+func validateFilesystemParameters(params map[string]string) error {
+	if _, err := parseFsckPolicy(params); err != nil {
+		return err
+	}
+	for key, value := range params {
+		if !strings.HasPrefix(key, mkfsOptionsKeyPrefix) {
+			continue
+		}
+		if !fsTypeRegexp.MatchString(strings.TrimPrefix(key, mkfsOptionsKeyPrefix)) {
+			return fmt.Errorf("invalid filesystem type in parameter %s", key)
+		}
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("parameter %s is empty", key)
+		}
+	}
+	return nil
+}
+
+// filesystemParameterKeys returns the mkfs and fsck parameters to hand to the node.
+func filesystemParameterKeys(params map[string]string) []string {
+	var keys []string
+	for key := range params {
+		if key == fsckPolicyKey || strings.HasPrefix(key, mkfsOptionsKeyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// formatAndMount formats a blank device with the configured mkfs arguments, checks an existing filesystem
+// according to the fsck policy and mounts it. Repairs and corruption are recorded as events on ref.
+func formatAndMount(source, target, fsType string, options []string, fs *filesystemOptions, recorder EventRecorder, ref *ObjectReference) error {
+	mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+	readOnly := false
+	for _, option := range options {
+		if option == "ro" {
+			readOnly = true
+		}
+	}
+
+	existingFormat, err := mounter.GetDiskFormat(source)
+	if err != nil {
+		return fmt.Errorf("failed to get disk format of %s: %v", source, err)
+	}
+
+	if existingFormat == "" {
+		if readOnly {
+			return fmt.Errorf("cannot format blank device %s for a read-only mount", source)
+		}
+		var args []string
+		if fsType == "ext4" || fsType == "ext3" {
+			args = []string{"-F", "-m0"}
+		}
+		args = append(append(args, fs.MkfsOptions...), source)
+		klog.Infof("Format blank device %s as %s: mkfs.%s %v", source, fsType, fsType, args)
+		if output, err := mounter.Exec.Command("mkfs."+fsType, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("mkfs.%s %v failed: %v, output: %s", fsType, args, err, strings.TrimSpace(string(output)))
+		}
+	} else {
+		if existingFormat != fsType {
+			klog.Warningf("Device %s holds a %s filesystem, but %s was requested", source, existingFormat, fsType)
+		}
+		// a filesystem mounted for another target path of the volume must not be checked
+		policy := fs.Fsck
+		if deviceMounted(mounter, source) {
+			policy = fsckNever
+		}
+		repaired, err := checkFilesystem(mounter, source, policy, readOnly)
+		if err != nil {
+			var corrupt *filesystemCorruptError
+			if errors.As(err, &corrupt) {
+				recorder.Eventf(ref, EventTypeWarning, "FilesystemCorrupt", "%v", err)
+			}
+			return err
+		}
+		if repaired != "" {
+			recorder.Eventf(ref, EventTypeWarning, "FilesystemRepaired", "fsck repaired the filesystem on %s: %s", source, repaired)
+		}
+	}
+
+	if err := mounter.Mount(source, target, fsType, append(options, "defaults")); err != nil {
+		return fmt.Errorf("failed to mount %s to %s: %v", source, target, err)
+	}
+	return nil
+}
+
+func deviceMounted(mounter mount.Interface, source string) bool {
+	device, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return false
+	}
+	mountPoints, err := mounter.List()
+	if err != nil {
+		klog.Warningf("failed to list mount points: %v", err)
+		return false
+	}
+	for _, mp := range mountPoints {
+		if mp.Device == device || mp.Device == source {
+			return true
+		}
+	}
+	return false
+}
+
+// buildMountOptions returns the mount options of a mount volume: ro or rw followed by the mount flags of its
+// capability, without empty and duplicate options. Flags are validated, in particular SELinux contexts, which
+// must be quoted when they hold MCS categories and cannot combine context= with the other context options.
+func buildMountOptions(readonly bool, flags []string) ([]string, error) {
+	var options []string
+	seen := make(map[string]bool)
+	contexts := make(map[string]string)
+	for _, flag := range flags {
+		// an unquoted MCS category list such as s0:c1,c2 would be split into separate options
+		name, value, _ := strings.Cut(strings.TrimSpace(flag), "=")
+		if seLinuxContextOptions[name] && strings.Contains(value, ",") && !strings.HasPrefix(value, `"`) {
+			return nil, fmt.Errorf("mount option %q must be quoted, as its context holds commas", flag)
+		}
+	}
+	for _, flag := range splitMountFlags(flags) {
+		if flag == "" || seen[flag] {
+			continue
+		}
+		seen[flag] = true
+		if strings.ContainsAny(flag, " \t\n") || strings.Count(flag, `"`)%2 != 0 {
+			return nil, fmt.Errorf("invalid mount option %q", flag)
+		}
+		switch flag {
+		case "ro":
+			readonly = true
+			continue
+		case "rw":
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(flag, "=")
+		if seLinuxContextOptions[name] {
+			if !hasValue || value == "" {
+				return nil, fmt.Errorf("mount option %s needs a context", name)
+			}
+			if previous, ok := contexts[name]; ok {
+				return nil, fmt.Errorf("conflicting mount options %s=%s and %s", name, previous, flag)
+			}
+			contexts[name] = value
+		}
+		options = append(options, flag)
+	}
+	if _, ok := contexts["context"]; ok && len(contexts) > 1 {
+		return nil, fmt.Errorf("mount option context cannot be combined with fscontext, defcontext or rootcontext")
+	}
+
+	mode := "rw"
+	if readonly {
+		mode = "ro"
+	}
+	return append([]string{mode}, options...), nil
+}
+
+// splitMountFlags splits mount flags holding several comma separated options, except for commas within quotes.
+func splitMountFlags(flags []string) []string {
+	var options []string
+	for _, flag := range flags {
+		start, quoted := 0, false
+		for i, c := range flag {
+			switch {
+			case c == '"':
+				quoted = !quoted
+			case c == ',' && !quoted:
+				options = append(options, strings.TrimSpace(flag[start:i]))
+				start = i + 1
+			}
+		}
+		options = append(options, strings.TrimSpace(flag[start:]))
+	}
+	return options
+}
+
+// parseMountGroup parses the VolumeMountGroup of a mount capability, kubelet passes the pod's fsGroup.
+func parseMountGroup(group string) (int, error) {
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return 0, fmt.Errorf("invalid volume mount group %q", group)
+	}
+	return gid, nil
+}
+
+// mountGroupOptions returns the mount options giving gid the files of filesystems that support them.
+func mountGroupOptions(fsType string, gid int) []string {
+	if !mountGroupOptionFsTypes[fsType] {
+		return nil
+	}
+	return []string{fmt.Sprintf("gid=%d", gid), "dmask=0002", "fmask=0113"}
+}
+
+// applyMountGroup makes the filesystem mounted at targetPath group-owned and group-writable by gid,
+// with setgid directories so that new files inherit the group. As with fsGroupChangePolicy OnRootMismatch,
+// the tree is only walked when its root is not set up yet, so remounts do not pay for a recursive chown.
+func applyMountGroup(targetPath string, gid int) error {
+	info, err := os.Stat(targetPath)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Gid) == gid &&
+		info.Mode()&os.ModeSetgid != 0 && info.Mode().Perm()&0070 == 0070 {
+		return nil
+	}
+
+	klog.Infof("Set group %d on the files of %s", gid, targetPath)
+	return filepath.Walk(targetPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(path, -1, gid); err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		mode := info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) | 0060
+		if info.IsDir() {
+			mode |= 0010 | os.ModeSetgid
+		}
+		return os.Chmod(path, mode)
+	})
+}
+
+// checkFilesystem runs fsck on source according to policy and returns its output when it repaired anything.
+func checkFilesystem(mounter *mount.SafeFormatAndMount, source string, policy fsckPolicy, readOnly bool) (string, error) {
+	var args []string
+	switch {
+	case policy == fsckNever, policy == fsckAuto && readOnly:
+		return "", nil
+	case policy == fsckAuto:
+		args = []string{"-a"}
+	case readOnly:
+		args = []string{"-f", "-n"}
+	default:
+		args = []string{"-f", "-a"}
+	}
+	args = append(args, source)
+
+	klog.V(4).Infof("Check filesystem on %s: fsck %v", source, args)
+	output, err := mounter.Exec.Command("fsck", args...).CombinedOutput()
+	out := strings.TrimSpace(string(output))
+	if err == nil {
+		return "", nil
+	}
+	if errors.Is(err, exec.ErrExecutableNotFound) {
+		klog.Warningf("fsck not found, mounting %s without checking it", source)
+		return "", nil
+	}
+	var exitErr exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return "", fmt.Errorf("fsck %v failed: %v", args, err)
+	}
+	switch code := exitErr.ExitStatus(); {
+	case code >= fsckOperationalError:
+		return "", fmt.Errorf("fsck %v failed with exit code %d: %s", args, code, out)
+	case code&fsckErrorsUncorrected != 0:
+		return "", &filesystemCorruptError{Device: source, Output: out}
+	case code&(fsckErrorsCorrected|fsckErrorsCorrectedReboot) != 0:
+		klog.Infof("fsck repaired the filesystem on %s: %s", source, out)
+		return out, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,385 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// controller states reported by /sys/class/nvme/<ctrl>/state
+const (
+	ctrlStateLive       = "live"
+	ctrlStateConnecting = "connecting"
+	ctrlStateResetting  = "resetting"
+	ctrlStateDeleting   = "deleting"
+	ctrlStateDead       = "dead"
+)
+
+// ANA states reported by /sys/class/nvme/<ctrl>/<path>/ana_state
+const (
+	anaStateOptimized      = "optimized"
+	anaStateNonOptimized   = "non-optimized"
+	anaStateInaccessible   = "inaccessible"
+	anaStatePersistentLoss = "persistent-loss"
+)
+
+// pod attributes passed in the volume context when podInfoOnMount is enabled
+const (
+	podNameContextKey      = "csi.storage.k8s.io/pod.name"
+	podNamespaceContextKey = "csi.storage.k8s.io/pod.namespace"
+	podUIDContextKey       = "csi.storage.k8s.io/pod.uid"
+)
+
+// controllerHealth is the observed state of one controller connected to a volume's subsystem.
+type controllerHealth struct {
+	Name      string
+	State     string
+	AnaStates map[string]string // path device -> ANA state
+}
+
+func (h *controllerHealth) abnormal() bool {
+	if h.State != ctrlStateLive {
+		return true
+	}
+	for _, ana := range h.AnaStates {
+		if ana == anaStateInaccessible || ana == anaStatePersistentLoss {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *controllerHealth) String() string {
+	if len(h.AnaStates) == 0 {
+		return fmt.Sprintf("%s %s", h.Name, h.State)
+	}
+	var paths []string
+	for path, ana := range h.AnaStates {
+		paths = append(paths, path+"="+ana)
+	}
+	sort.Strings(paths)
+	return fmt.Sprintf("%s %s (ana: %s)", h.Name, h.State, strings.Join(paths, ","))
+}
+
+type monitoredVolume struct {
+	connector   *Connector
+	ref         *ObjectReference
+	controllers map[string]*controllerHealth
+}
+
+// healthMonitor periodically checks the controllers of every volume published on this node,
+// records events on state transitions and reports the resulting VolumeCondition.
+type healthMonitor struct {
+	mu        sync.Mutex
+	volumes   map[string]*monitoredVolume
+	recorder  EventRecorder
+	throttler *cgroupIOThrottler
+	interval  time.Duration
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+}
+
+func newHealthMonitor(recorder EventRecorder, interval time.Duration, throttler *cgroupIOThrottler) *healthMonitor {
+	return &healthMonitor{
+		volumes:   make(map[string]*monitoredVolume),
+		recorder:  recorder,
+		throttler: throttler,
+		interval:  interval,
+		stopCh:    make(chan struct{}),
+	}
+}
+
+// volumeObjectReference points events at the publishing pod when kubelet passed pod info, at the claim
+// when the provisioner passed it and at the PersistentVolume named after the volume otherwise.
+func volumeObjectReference(volumeID string, volumeContext map[string]string) *ObjectReference {
+	if name := volumeContext[podNameContextKey]; name != "" {
+		return &ObjectReference{
+			Kind:       "Pod",
+			Namespace:  volumeContext[podNamespaceContextKey],
+			Name:       name,
+			UID:        volumeContext[podUIDContextKey],
+			APIVersion: "v1",
+		}
+	}
+	if name := volumeContext[pvcNameContextKey]; name != "" {
+		return &ObjectReference{Kind: "PersistentVolumeClaim", Namespace: volumeContext[pvcNamespaceContextKey], Name: name, APIVersion: "v1"}
+	}
+	return &ObjectReference{Kind: "PersistentVolume", Name: volumeID, APIVersion: "v1"}
+}
+
+// Watch starts monitoring the controllers of a published volume, recording events on the connector's EventRef.
+// The monitor keeps its own copy of the connector, publish and unpublish hand it the new state with Watch.
+func (m *healthMonitor) Watch(volumeID string, c *Connector) {
+	c = c.clone()
+	ref := c.EventRef
+	if ref == nil {
+		ref = volumeObjectReference(volumeID, nil)
+	}
+	controllers := make(map[string]*controllerHealth)
+	for _, h := range getControllersHealth(c) {
+		controllers[h.Name] = h
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.volumes[volumeID] = &monitoredVolume{connector: c, ref: ref, controllers: controllers}
+}
+
+// Unwatch stops monitoring a volume, usually because it was unpublished.
+func (m *healthMonitor) Unwatch(volumeID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.volumes, volumeID)
+}
+
+// Condition returns the current condition of a volume's controllers.
+func (m *healthMonitor) Condition(volumeID string) *csi.VolumeCondition {
+	m.mu.Lock()
+	vol, ok := m.volumes[volumeID]
+	m.mu.Unlock()
+	if !ok {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume %s is not published on this node", volumeID)}
+	}
+
+	return volumeCondition(vol.connector, getControllersHealth(vol.connector))
+}
+
+func volumeCondition(c *Connector, controllers []*controllerHealth) *csi.VolumeCondition {
+	if len(controllers) == 0 {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("no controller connected to subsystem %s", c.TargetNqn)}
+	}
+
+	var abnormal, states []string
+	for _, h := range controllers {
+		states = append(states, h.String())
+		if h.abnormal() {
+			abnormal = append(abnormal, h.String())
+		}
+	}
+	if len(abnormal) > 0 {
+		return &csi.VolumeCondition{Abnormal: true, Message: "unhealthy controllers: " + strings.Join(abnormal, "; ")}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "controllers: " + strings.Join(states, "; ")}
+}
+
+// Run loads the volumes already published before a restart and checks them every interval, 0 disabling
+// the checks, until Stop is called. Settings are reapplied whenever a namespace of a volume is added again.
+func (m *healthMonitor) Run() {
+	m.loadPublishedVolumes()
+
+	// a reconnect shorter than the interval goes unseen by the checks, but brings the namespace
+	// or its path devices back with their queues reset
+	added, cancel := subscribeNvmeNamespaces()
+	defer cancel()
+
+	var tick <-chan time.Time
+	if m.interval > 0 {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			m.check()
+		case ev := <-added:
+			m.namespaceAdded(strings.TrimPrefix(ev.DevName, "/dev/"))
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+func (m *healthMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
+}
+
+func (m *healthMonitor) loadPublishedVolumes() {
+	files, err := filepath.Glob(filepath.Join(DefaultVolumeMapPath, "*.json"))
+	if err != nil {
+		klog.Errorf("HealthMonitor: list connector files error: %v", err)
+		return
+	}
+
+	for _, file := range files {
+		c, err := GetConnectorFromFile(file)
+		if err != nil {
+			klog.Warningf("HealthMonitor: skip connector file %s: %v", file, err)
+			continue
+		}
+		if c.Ephemeral && len(c.TargetPaths) == 0 {
+			// an inline volume already disconnected, waiting to be deleted
+			continue
+		}
+		volumeID := strings.TrimSuffix(filepath.Base(file), ".json")
+		m.mu.Lock()
+		_, watched := m.volumes[volumeID]
+		m.mu.Unlock()
+		if !watched {
+			m.Watch(volumeID, c)
+		}
+	}
+}
+
+// namespaceAdded reapplies the settings of the volume whose namespace devName belongs to.
+func (m *healthMonitor) namespaceAdded(devName string) {
+	m.mu.Lock()
+	volumes := make(map[string]*monitoredVolume, len(m.volumes))
+	for volumeID, vol := range m.volumes {
+		volumes[volumeID] = vol
+	}
+	m.mu.Unlock()
+
+	for volumeID, vol := range volumes {
+		if namespaceMatches(devName, vol.connector.TargetNqn, vol.connector.DeviceID) {
+			klog.Infof("HealthMonitor: namespace %s of volume %s was added, reapplying its settings", devName, volumeID)
+			m.reapply(volumeID, vol)
+		}
+	}
+}
+
+func (m *healthMonitor) check() {
+	// events may take a while to post, so do not hold the lock against publish/unpublish
+	m.mu.Lock()
+	volumes := make(map[string]*monitoredVolume, len(m.volumes))
+	for volumeID, vol := range m.volumes {
+		volumes[volumeID] = vol
+	}
+	m.mu.Unlock()
+
+	for volumeID, vol := range volumes {
+		current := make(map[string]*controllerHealth)
+		for _, h := range getControllersHealth(vol.connector) {
+			current[h.Name] = h
+			m.recordTransition(volumeID, vol, vol.controllers[h.Name], h)
+		}
+		for name, prev := range vol.controllers {
+			if _, ok := current[name]; !ok && !prev.abnormal() {
+				m.recorder.Eventf(vol.ref, EventTypeWarning, "ControllerRemoved",
+					"volume %s: controller %s of subsystem %s disappeared", volumeID, name, vol.connector.TargetNqn)
+			}
+		}
+		vol.controllers = current
+	}
+}
+
+func (m *healthMonitor) recordTransition(volumeID string, vol *monitoredVolume, prev, cur *controllerHealth) {
+	if prev == nil || prev.State != cur.State {
+		switch cur.State {
+		case ctrlStateConnecting:
+			m.recorder.Eventf(vol.ref, EventTypeWarning, "ControllerConnecting",
+				"volume %s: controller %s lost its connection to %s and is reconnecting", volumeID, cur.Name, vol.connector.TargetAddr)
+		case ctrlStateResetting:
+			m.recorder.Eventf(vol.ref, EventTypeWarning, "ControllerResetting",
+				"volume %s: controller %s is resetting", volumeID, cur.Name)
+		case ctrlStateDead, ctrlStateDeleting:
+			m.recorder.Eventf(vol.ref, EventTypeWarning, "ControllerDead",
+				"volume %s: controller %s is %s, path to %s is lost", volumeID, cur.Name, cur.State, vol.connector.TargetAddr)
+		case ctrlStateLive:
+			if prev != nil {
+				m.recorder.Eventf(vol.ref, EventTypeNormal, "ControllerLive",
+					"volume %s: controller %s is live again", volumeID, cur.Name)
+				m.reapply(volumeID, vol)
+			}
+		}
+	}
+
+	for path, ana := range cur.AnaStates {
+		if prev != nil && prev.AnaStates[path] == ana {
+			continue
+		}
+		switch ana {
+		case anaStateInaccessible, anaStatePersistentLoss:
+			m.recorder.Eventf(vol.ref, EventTypeWarning, "PathInaccessible",
+				"volume %s: path %s of controller %s is %s", volumeID, path, cur.Name, ana)
+		case anaStateOptimized, anaStateNonOptimized:
+			if prev != nil {
+				m.recorder.Eventf(vol.ref, EventTypeNormal, "PathAccessible",
+					"volume %s: path %s of controller %s is %s", volumeID, path, cur.Name, ana)
+			}
+		}
+	}
+}
+
+// reapply sets the read-only flag, queue tuning and I/O limits of a volume again after a reconnect:
+// the namespace may have come back as a new device, with its paths' queues reset.
+func (m *healthMonitor) reapply(volumeID string, vol *monitoredVolume) {
+	if err := vol.connector.applyReadOnly(); err != nil {
+		m.recorder.Eventf(vol.ref, EventTypeWarning, "ReadOnlyFailed",
+			"volume %s: reapply read-only after reconnect: %v", volumeID, err)
+	}
+	if err := vol.connector.applyQueueSettings(); err != nil {
+		m.recorder.Eventf(vol.ref, EventTypeWarning, "QueueTuningFailed",
+			"volume %s: reapply queue tuning after reconnect: %v", volumeID, err)
+	}
+	if err := vol.connector.applyIOLimits(m.throttler); err != nil {
+		m.recorder.Eventf(vol.ref, EventTypeWarning, "IOLimitsFailed",
+			"volume %s: reapply I/O limits after reconnect: %v", volumeID, err)
+	}
+}
+
+// getControllersHealth reads the state and ANA states of every controller connected to the connector's subsystem.
+func getControllersHealth(c *Connector) []*controllerHealth {
+	devices, err := os.ReadDir(SYS_NVMF)
+	if err != nil {
+		klog.Errorf("HealthMonitor: readdir %s err: %v", SYS_NVMF, err)
+		return nil
+	}
+
+	var controllers []*controllerHealth
+	for _, device := range devices {
+		ctrl := device.Name()
+		nqn, err := readSysfsAttr(filepath.Join(SYS_NVMF, ctrl, "subsysnqn"))
+		if err != nil || nqn != c.TargetNqn {
+			continue
+		}
+		if c.HostNqn != "" {
+			hostnqn, err := readSysfsAttr(filepath.Join(SYS_NVMF, ctrl, "hostnqn"))
+			if err == nil && hostnqn != c.HostNqn {
+				continue
+			}
+		}
+
+		state, err := readSysfsAttr(filepath.Join(SYS_NVMF, ctrl, "state"))
+		if err != nil {
+			klog.Warningf("HealthMonitor: read state of controller %s err: %v", ctrl, err)
+			state = "unknown"
+		}
+		h := &controllerHealth{Name: ctrl, State: state, AnaStates: make(map[string]string)}
+
+		paths, _ := filepath.Glob(filepath.Join(SYS_NVMF, ctrl, "nvme*c*n*"))
+		for _, path := range paths {
+			if ana, err := readSysfsAttr(filepath.Join(path, "ana_state")); err == nil {
+				h.AnaStates[filepath.Base(path)] = ana
+			}
+		}
+		controllers = append(controllers, h)
+	}
+	return controllers
+}
@@ -25,6 +25,8 @@ import (
 )
 
 type IdentityServer struct {
+	csi.UnimplementedIdentityServer
+
 	Driver *driver
 }
 
@@ -76,6 +78,16 @@ func (ids *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.G
 			},
 		},
 	}
+	// the external-provisioner sets node affinity on volumes only when the plugin has accessibility constraints
+	if ids.Driver.hasTopology() {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
 
 	return resp, nil
 }
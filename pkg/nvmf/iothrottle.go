@@ -0,0 +1,227 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const cgroupIOMaxFile = "io.max"
+
+// volume context and modify volume parameters limiting the I/O of a volume per pod, unset or "max" is unlimited
+const (
+	readIOPSKey  = "readIOPS"
+	writeIOPSKey = "writeIOPS"
+	readBPSKey   = "readBPS"
+	writeBPSKey  = "writeBPS"
+)
+
+var ioLimitKeys = []string{readIOPSKey, writeIOPSKey, readBPSKey, writeBPSKey}
+
+// ioLimits are the io.max limits of a device, 0 means unlimited
+type ioLimits struct {
+	ReadIOPS  uint64 `json:",omitempty"`
+	WriteIOPS uint64 `json:",omitempty"`
+	ReadBPS   uint64 `json:",omitempty"`
+	WriteBPS  uint64 `json:",omitempty"`
+}
+
+// parseIOLimits reads the I/O limits from volume context or parameters, returning nil when none is set.
+// Bandwidths accept the size suffixes of parseSize.
+func parseIOLimits(params map[string]string) (*ioLimits, error) {
+	limits := &ioLimits{}
+	set := false
+	for _, key := range ioLimitKeys {
+		value, ok := params[key]
+		if !ok {
+			continue
+		}
+		set = true
+
+		var limit uint64
+		if value != "max" {
+			var n int64
+			var err error
+			if key == readBPSKey || key == writeBPSKey {
+				n, err = parseSize(value)
+			} else {
+				n, err = strconv.ParseInt(value, 10, 64)
+				if err == nil && n <= 0 {
+					err = fmt.Errorf("must be positive")
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+			}
+			limit = uint64(n)
+		}
+
+		switch key {
+		case readIOPSKey:
+			limits.ReadIOPS = limit
+		case writeIOPSKey:
+			limits.WriteIOPS = limit
+		case readBPSKey:
+			limits.ReadBPS = limit
+		case writeBPSKey:
+			limits.WriteBPS = limit
+		}
+	}
+	if !set {
+		return nil, nil
+	}
+	return limits, nil
+}
+
+// formatIOMax returns the io.max line setting limits on device major:minor, unlimited values are "max".
+func formatIOMax(major, minor uint32, limits *ioLimits) string {
+	value := func(v uint64) string {
+		if v == 0 {
+			return "max"
+		}
+		return strconv.FormatUint(v, 10)
+	}
+	if limits == nil {
+		limits = &ioLimits{}
+	}
+	return fmt.Sprintf("%d:%d rbps=%s wbps=%s riops=%s wiops=%s", major, minor,
+		value(limits.ReadBPS), value(limits.WriteBPS), value(limits.ReadIOPS), value(limits.WriteIOPS))
+}
+
+// cgroupIOThrottler writes io.max limits into the cgroup v2 hierarchy mounted at root.
+type cgroupIOThrottler struct {
+	root string
+}
+
+func newCgroupIOThrottler(root string) *cgroupIOThrottler {
+	return &cgroupIOThrottler{root: root}
+}
+
+// podCgroup finds the cgroup of a pod as created by kubelet with either the systemd or the cgroupfs driver.
+func (t *cgroupIOThrottler) podCgroup(podUID string) (string, error) {
+	if podUID == "" || strings.ContainsAny(podUID, "/*?[") {
+		return "", fmt.Errorf("invalid pod uid %q", podUID)
+	}
+	systemdUID := strings.ReplaceAll(podUID, "-", "_")
+	patterns := []string{
+		// systemd: guaranteed pods sit directly in kubepods.slice, the others in their QoS slice
+		filepath.Join(t.root, "kubepods.slice", "kubepods-pod"+systemdUID+".slice"),
+		filepath.Join(t.root, "kubepods.slice", "kubepods-*.slice", "kubepods-*-pod"+systemdUID+".slice"),
+		// cgroupfs
+		filepath.Join(t.root, "kubepods", "pod"+podUID),
+		filepath.Join(t.root, "kubepods", "*", "pod"+podUID),
+	}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		if len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+	return "", fmt.Errorf("cgroup of pod %s not found under %s", podUID, t.root)
+}
+
+// setIOMax writes the limits of device major:minor into the io.max file of cgroupDir.
+func (t *cgroupIOThrottler) setIOMax(cgroupDir string, major, minor uint32, limits *ioLimits) error {
+	path := filepath.Join(cgroupDir, cgroupIOMaxFile)
+	line := formatIOMax(major, minor, limits)
+	if err := os.WriteFile(path, []byte(line), 0644); err != nil {
+		return fmt.Errorf("write %q to %s: %v", line, path, err)
+	}
+	klog.V(4).Infof("IO throttle: %s: %s", path, line)
+	return nil
+}
+
+// deviceNumber returns the major and minor number of a block device
+func deviceNumber(devicePath string) (uint32, uint32, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(devicePath, &stat); err != nil {
+		return 0, 0, fmt.Errorf("stat %s: %v", devicePath, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return 0, 0, fmt.Errorf("%s is not a block device", devicePath)
+	}
+	return unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev)), nil
+}
+
+// publishedDevicePath returns the device the volume is published through: its dm-crypt mapping when
+// encrypted, as the pod's I/O is submitted there, and the namespace otherwise.
+func (c *Connector) publishedDevicePath() (string, error) {
+	if c.Encrypted {
+		return luksMapperPath(c.VolumeID), nil
+	}
+	devName, err := findNamespaceDevice(c.TargetNqn, c.DeviceID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join("/dev", devName), nil
+}
+
+// applyIOLimits writes the connector's limits for its current device into the cgroups of the pods using it.
+// The device number changes when the namespace is reconnected, so this is repeated after reconnects.
+func (c *Connector) applyIOLimits(t *cgroupIOThrottler) error {
+	if c.IOLimits == nil || len(c.PodCgroups) == 0 {
+		return nil
+	}
+	devicePath, err := c.publishedDevicePath()
+	if err != nil {
+		return err
+	}
+	major, minor, err := deviceNumber(devicePath)
+	if err != nil {
+		return err
+	}
+	for _, cgroupDir := range c.PodCgroups {
+		if err := t.setIOMax(cgroupDir, major, minor, c.IOLimits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearIOLimits lifts the limits of the pod published to targetPath, a pod cgroup that is already gone is skipped.
+func (c *Connector) clearIOLimits(t *cgroupIOThrottler, targetPath string) error {
+	cgroupDir, ok := c.PodCgroups[targetPath]
+	if !ok {
+		return nil
+	}
+	delete(c.PodCgroups, targetPath)
+	if c.IOLimits == nil {
+		return nil
+	}
+	if _, err := os.Stat(cgroupDir); os.IsNotExist(err) {
+		return nil
+	}
+	devicePath, err := c.publishedDevicePath()
+	if err != nil {
+		return err
+	}
+	major, minor, err := deviceNumber(devicePath)
+	if err != nil {
+		return err
+	}
+	return t.setIOMax(cgroupDir, major, minor, nil)
+}
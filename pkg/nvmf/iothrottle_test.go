@@ -0,0 +1,218 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIOLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    *ioLimits
+		wantErr bool
+	}{
+		{
+			name:   "none",
+			params: map[string]string{"fsType": "ext4"},
+		},
+		{
+			name:   "all",
+			params: map[string]string{readIOPSKey: "1000", writeIOPSKey: "500", readBPSKey: "100Mi", writeBPSKey: "1G"},
+			want:   &ioLimits{ReadIOPS: 1000, WriteIOPS: 500, ReadBPS: 100 << 20, WriteBPS: 1000 * 1000 * 1000},
+		},
+		{
+			name:   "max is unlimited",
+			params: map[string]string{readIOPSKey: "max", writeBPSKey: "4096"},
+			want:   &ioLimits{WriteBPS: 4096},
+		},
+		{
+			name:    "zero iops",
+			params:  map[string]string{writeIOPSKey: "0"},
+			wantErr: true,
+		},
+		{
+			name:    "negative iops",
+			params:  map[string]string{readIOPSKey: "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "iops with suffix",
+			params:  map[string]string{readIOPSKey: "1K"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid bandwidth",
+			params:  map[string]string{readBPSKey: "fast"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIOLimits(tt.params)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseIOLimits() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIOLimits() error: %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseIOLimits() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatIOMax(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits *ioLimits
+		want   string
+	}{
+		{"cleared", nil, "259:3 rbps=max wbps=max riops=max wiops=max"},
+		{"partial", &ioLimits{WriteBPS: 1 << 20, ReadIOPS: 10}, "259:3 rbps=max wbps=1048576 riops=10 wiops=max"},
+		{"all", &ioLimits{ReadBPS: 1, WriteBPS: 2, ReadIOPS: 3, WriteIOPS: 4}, "259:3 rbps=1 wbps=2 riops=3 wiops=4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatIOMax(259, 3, tt.limits); got != tt.want {
+				t.Errorf("formatIOMax() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodCgroup(t *testing.T) {
+	const uid = "5f8c2a1e-7d3b-4c4e-9a0f-1b2c3d4e5f60"
+	const systemdUID = "5f8c2a1e_7d3b_4c4e_9a0f_1b2c3d4e5f60"
+
+	tests := []struct {
+		name    string
+		dirs    []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "systemd guaranteed",
+			dirs: []string{"kubepods.slice/kubepods-pod" + systemdUID + ".slice"},
+			want: "kubepods.slice/kubepods-pod" + systemdUID + ".slice",
+		},
+		{
+			name: "systemd burstable",
+			dirs: []string{"kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + systemdUID + ".slice"},
+			want: "kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + systemdUID + ".slice",
+		},
+		{
+			name: "cgroupfs guaranteed",
+			dirs: []string{"kubepods/pod" + uid},
+			want: "kubepods/pod" + uid,
+		},
+		{
+			name: "cgroupfs besteffort",
+			dirs: []string{"kubepods/besteffort/pod" + uid},
+			want: "kubepods/besteffort/pod" + uid,
+		},
+		{
+			name:    "other pod",
+			dirs:    []string{"kubepods.slice/kubepods-podffffffff_0000_0000_0000_000000000000.slice", "kubepods/besteffort/podother"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, dir := range tt.dirs {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := newCgroupIOThrottler(root).podCgroup(uid)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("podCgroup() = %s, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("podCgroup() error: %v", err)
+			}
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Errorf("podCgroup() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestPodCgroupInvalidUID(t *testing.T) {
+	throttler := newCgroupIOThrottler(t.TempDir())
+	for _, uid := range []string{"", "../kubepods", "*"} {
+		if got, err := throttler.podCgroup(uid); err == nil {
+			t.Errorf("podCgroup(%q) = %s, want error", uid, got)
+		}
+	}
+}
+
+func TestSetIOMax(t *testing.T) {
+	cgroupDir := t.TempDir()
+	throttler := newCgroupIOThrottler(filepath.Dir(cgroupDir))
+
+	if err := throttler.setIOMax(cgroupDir, 8, 16, &ioLimits{ReadIOPS: 100, WriteBPS: 2 << 20}); err != nil {
+		t.Fatalf("setIOMax() error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(cgroupDir, cgroupIOMaxFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "8:16 rbps=max wbps=2097152 riops=100 wiops=max"; string(data) != want {
+		t.Errorf("io.max = %q, want %q", data, want)
+	}
+
+	if err := throttler.setIOMax(cgroupDir, 8, 16, nil); err != nil {
+		t.Fatalf("setIOMax() clear error: %v", err)
+	}
+	data, _ = os.ReadFile(filepath.Join(cgroupDir, cgroupIOMaxFile))
+	if want := "8:16 rbps=max wbps=max riops=max wiops=max"; string(data) != want {
+		t.Errorf("io.max = %q, want %q", data, want)
+	}
+
+	if err := throttler.setIOMax(filepath.Join(cgroupDir, "gone"), 8, 16, nil); err == nil {
+		t.Errorf("setIOMax() into a missing cgroup succeeded, want error")
+	}
+}
+
+func TestClearIOLimitsOfRemovedPod(t *testing.T) {
+	throttler := newCgroupIOThrottler(t.TempDir())
+	c := &Connector{
+		IOLimits:   &ioLimits{ReadIOPS: 100},
+		PodCgroups: map[string]string{"/target": filepath.Join(t.TempDir(), "gone")},
+	}
+	if err := c.clearIOLimits(throttler, "/target"); err != nil {
+		t.Fatalf("clearIOLimits() of a removed pod cgroup error: %v", err)
+	}
+	if len(c.PodCgroups) != 0 {
+		t.Errorf("clearIOLimits() kept pod cgroups %v", c.PodCgroups)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+)
+
+const (
+	// volume context key enabling LUKS encryption of the namespace
+	encryptionKey = "encryption"
+	// node publish secret key holding the LUKS passphrase; the driver has no NodeStageVolume, which
+	// is the only call kubelet passes node stage secrets to
+	encryptionPassphraseKey = "passphrase"
+
+	dmMapperDir        = "/dev/mapper"
+	luksMapperPrefix   = "nvmf-"
+	cryptsetupBin      = "cryptsetup"
+	cryptsetupNotFound = 4 // exit code of cryptsetup for a missing device or mapping
+)
+
+// encryptionRequested parses the encryption flag of the volume context.
+func encryptionRequested(volumeContext map[string]string) (bool, error) {
+	value, ok := volumeContext[encryptionKey]
+	if !ok {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", encryptionKey, value, err)
+	}
+	return enabled, nil
+}
+
+func luksMapperName(volumeID string) string {
+	return luksMapperPrefix + volumeID
+}
+
+func luksMapperPath(volumeID string) string {
+	return filepath.Join(dmMapperDir, luksMapperName(volumeID))
+}
+
+func runCryptsetup(passphrase string, args ...string) error {
+	cmd := exec.New().Command(cryptsetupBin, args...)
+	if passphrase != "" {
+		cmd.SetStdin(strings.NewReader(passphrase))
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup %s failed: %w, output: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// openEncryptedDevice opens the LUKS container on devicePath as a dm-crypt mapping named after the volume
+// and returns the mapping's path. A blank device is formatted first, unless it is published read-only, any
+// other content is refused so that existing data is never overwritten.
+func openEncryptedDevice(devicePath, volumeID, passphrase string, readonly bool) (string, error) {
+	mapperPath := luksMapperPath(volumeID)
+	if _, err := os.Stat(mapperPath); err == nil {
+		// already opened for another target path of the volume
+		return mapperPath, nil
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("encrypted volume %s needs a %q node publish secret", volumeID, encryptionPassphraseKey)
+	}
+
+	if err := runCryptsetup("", "isLuks", devicePath); err != nil {
+		mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
+		format, ferr := mounter.GetDiskFormat(devicePath)
+		if ferr != nil {
+			return "", fmt.Errorf("failed to get format of %s: %v", devicePath, ferr)
+		}
+		if format != "" {
+			return "", fmt.Errorf("device %s of encrypted volume %s holds unencrypted %q data, refusing to format it", devicePath, volumeID, format)
+		}
+		if readonly {
+			return "", fmt.Errorf("encrypted volume %s is blank, refusing to format it for a read-only publish", volumeID)
+		}
+		klog.Infof("Encrypted volume %s: luksFormat blank device %s", volumeID, devicePath)
+		if err := runCryptsetup(passphrase, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", devicePath); err != nil {
+			return "", err
+		}
+	}
+
+	// the volume key is kept in the dm table rather than the kernel keyring, so that resize needs no passphrase
+	if err := runCryptsetup(passphrase, "luksOpen", "--disable-keyring", "--allow-discards", "--key-file", "-", devicePath, luksMapperName(volumeID)); err != nil {
+		return "", err
+	}
+	klog.Infof("Encrypted volume %s: opened %s as %s", volumeID, devicePath, mapperPath)
+	return mapperPath, nil
+}
+
+// closeEncryptedDevice closes the dm-crypt mapping of a volume, doing nothing when it is not open.
+func closeEncryptedDevice(volumeID string) error {
+	if _, err := os.Stat(luksMapperPath(volumeID)); os.IsNotExist(err) {
+		return nil
+	}
+	err := runCryptsetup("", "luksClose", luksMapperName(volumeID))
+	var exitErr exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitStatus() == cryptsetupNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	klog.Infof("Encrypted volume %s: closed %s", volumeID, luksMapperPath(volumeID))
+	return nil
+}
+
+// resizeEncryptedDevice grows the dm-crypt mapping of a volume to the size of the underlying device.
+func resizeEncryptedDevice(volumeID string) error {
+	if err := runCryptsetup("", "resize", luksMapperName(volumeID)); err != nil {
+		return err
+	}
+	klog.Infof("Encrypted volume %s: resized %s", volumeID, luksMapperPath(volumeID))
+	return nil
+}
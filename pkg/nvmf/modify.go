@@ -0,0 +1,286 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// how often nodes look up the VolumeAttributesClass of the claims of their published volumes
+const modifyReconcileInterval = 5 * time.Minute
+
+// mutableParameterKeys are the parameters ControllerModifyVolume accepts, usually from a VolumeAttributesClass.
+// The backend records them and nodes apply them on the next publish, or when the reconciler finds them changed.
+var mutableParameterKeys = append(append(append([]string(nil), ioLimitKeys...), queueSettingKeys...), connectOptionKeys...)
+
+// VolumeAttributesClass went GA in storage.k8s.io/v1 with Kubernetes 1.34, older clusters serve v1beta1
+var volumeAttributesClassVersions = []string{"v1", "v1beta1"}
+
+func isMutableParameterKey(key string) bool {
+	for _, mutable := range mutableParameterKeys {
+		if key == mutable {
+			return true
+		}
+	}
+	return false
+}
+
+// validateMutableParameters checks that params only sets mutable parameters, to well formed values.
+func validateMutableParameters(params map[string]string) error {
+	for key := range params {
+		if !isMutableParameterKey(key) {
+			return fmt.Errorf("parameter %q cannot be modified, mutable parameters are %s", key, strings.Join(mutableParameterKeys, ", "))
+		}
+	}
+	if _, err := parseIOLimits(params); err != nil {
+		return err
+	}
+	if _, err := parseQueueSettings(params); err != nil {
+		return err
+	}
+	if _, err := parseConnectOptions(params); err != nil {
+		return err
+	}
+	return nil
+}
+
+// mergeMutableParameters returns params with the mutable parameters of modified set on top, other keys of modified are ignored.
+func mergeMutableParameters(params, modified map[string]string) map[string]string {
+	merged := make(map[string]string, len(params)+len(modified))
+	for key, value := range params {
+		merged[key] = value
+	}
+	for key, value := range modified {
+		if isMutableParameterKey(key) {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// replaceMutableParameters returns params with its mutable parameters replaced by those of mutable.
+func replaceMutableParameters(params, mutable map[string]string) map[string]string {
+	replaced := make(map[string]string, len(params)+len(mutable))
+	for key, value := range params {
+		if !isMutableParameterKey(key) {
+			replaced[key] = value
+		}
+	}
+	for key, value := range mutable {
+		if isMutableParameterKey(key) {
+			replaced[key] = value
+		}
+	}
+	return replaced
+}
+
+// mutableParameters returns the mutable parameters set in params, nil when there is none.
+func mutableParameters(params map[string]string) map[string]string {
+	var mutable map[string]string
+	for _, key := range mutableParameterKeys {
+		if value, ok := params[key]; ok {
+			if mutable == nil {
+				mutable = make(map[string]string)
+			}
+			mutable[key] = value
+		}
+	}
+	return mutable
+}
+
+type volumeAttributesClass struct {
+	DriverName string            `json:"driverName"`
+	Parameters map[string]string `json:"parameters"`
+}
+
+// attributesReconciler applies the VolumeAttributesClass of their claim to the volumes published on this node.
+// ControllerModifyVolume only reaches the controller, and the publish context a node gets is fixed when the
+// volume is attached, so a volume modified while attached would otherwise keep its parameters until detached.
+type attributesReconciler struct {
+	node     *NodeServer
+	kube     *kubeClient
+	recorder EventRecorder
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newAttributesReconciler(node *NodeServer, recorder EventRecorder) *attributesReconciler {
+	kube, err := newKubeClient()
+	if err != nil {
+		klog.Warningf("AttributesReconciler: modified volumes are only updated on their next publish: %v", err)
+	}
+	return &attributesReconciler{
+		node:     node,
+		kube:     kube,
+		recorder: recorder,
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Run checks the published volumes every modifyReconcileInterval until Stop is called.
+func (r *attributesReconciler) Run() {
+	ticker := time.NewTicker(modifyReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.check()
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+func (r *attributesReconciler) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
+}
+
+func (r *attributesReconciler) check() {
+	files, err := filepath.Glob(filepath.Join(DefaultVolumeMapPath, "*.json"))
+	if err != nil {
+		klog.Errorf("AttributesReconciler: list connector files error: %v", err)
+		return
+	}
+
+	for _, file := range files {
+		c, err := GetConnectorFromFile(file)
+		if err != nil || c.PVCName == "" || len(c.TargetPaths) == 0 {
+			continue
+		}
+		class, err := r.classParameters(c)
+		if err != nil {
+			klog.Warningf("AttributesReconciler: get VolumeAttributesClass of PVC %s/%s error: %v", c.PVCNamespace, c.PVCName, err)
+			continue
+		}
+		if class != nil {
+			r.reconcile(strings.TrimSuffix(filepath.Base(file), ".json"), file, class)
+		}
+	}
+}
+
+// classParameters returns the parameters of the VolumeAttributesClass the claim was last modified to,
+// nil when it has none.
+func (r *attributesReconciler) classParameters(c *Connector) (map[string]string, error) {
+	var pvc struct {
+		Status struct {
+			CurrentVolumeAttributesClassName string `json:"currentVolumeAttributesClassName"`
+		} `json:"status"`
+	}
+	if err := r.kube.get(fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", c.PVCNamespace, c.PVCName), &pvc); err != nil {
+		return nil, err
+	}
+	name := pvc.Status.CurrentVolumeAttributesClassName
+	if name == "" {
+		return nil, nil
+	}
+
+	var class volumeAttributesClass
+	var err error
+	for _, version := range volumeAttributesClassVersions {
+		if err = r.kube.get(fmt.Sprintf("/apis/storage.k8s.io/%s/volumeattributesclasses/%s", version, name), &class); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if class.DriverName != r.node.Driver.name {
+		return nil, fmt.Errorf("VolumeAttributesClass %s is for driver %s", name, class.DriverName)
+	}
+	if class.Parameters == nil {
+		return map[string]string{}, nil
+	}
+	return class.Parameters, nil
+}
+
+// reconcile applies the parameters of the class on top of those of the volume context to a published volume,
+// when they differ from the ones in effect. A key the class no longer sets falls back to the volume context.
+func (r *attributesReconciler) reconcile(volumeID, connectorFilePath string, class map[string]string) {
+	if !r.node.lockVolume(volumeID) {
+		klog.Infof("AttributesReconciler: volume %s is busy, checking it later", volumeID)
+		return
+	}
+	defer r.node.unlockVolume(volumeID)
+
+	// the volume may have been unpublished while the class was looked up
+	c, err := GetConnectorFromFile(connectorFilePath)
+	if err != nil || len(c.TargetPaths) == 0 {
+		return
+	}
+	params := mutableParameters(mergeMutableParameters(c.ContextParameters, class))
+	if reflect.DeepEqual(params, c.MutableParameters) {
+		return
+	}
+	ref := c.EventRef
+	if ref == nil {
+		ref = volumeObjectReference(volumeID, nil)
+	}
+	queueSettings, err := parseQueueSettings(params)
+	if err != nil {
+		r.recorder.Eventf(ref, EventTypeWarning, "VolumeModifyFailed", "volume %s: %v", volumeID, err)
+		return
+	}
+	limits, err := parseIOLimits(params)
+	if err != nil {
+		r.recorder.Eventf(ref, EventTypeWarning, "VolumeModifyFailed", "volume %s: %v", volumeID, err)
+		return
+	}
+	connectOptions, err := parseConnectOptions(params)
+	if err != nil {
+		r.recorder.Eventf(ref, EventTypeWarning, "VolumeModifyFailed", "volume %s: %v", volumeID, err)
+		return
+	}
+
+	klog.Infof("AttributesReconciler: apply parameters %v to volume %s", params, volumeID)
+	c.MutableParameters = params
+	c.QueueSettings = queueSettings
+	c.IOLimits = limits
+	// the connection is kept, new connect options are used when the volume is connected again
+	c.ConnectOptions = connectOptions
+	var errs []string
+	if err := c.applyQueueSettings(); err != nil {
+		errs = append(errs, fmt.Sprintf("queue tuning: %v", err))
+	}
+	if err := c.applyIOLimits(r.node.Driver.throttler); err != nil {
+		errs = append(errs, fmt.Sprintf("I/O limits: %v", err))
+	}
+	if limits != nil && len(c.PodCgroups) < len(c.TargetPaths) {
+		errs = append(errs, "I/O limits: the cgroups of some pods are unknown, their limits change when they are published again")
+	}
+	// the parameters are kept even when applying them failed, so that reconnects and later publishes retry them
+	if err := persistConnectorFile(c, connectorFilePath); err != nil {
+		klog.Errorf("AttributesReconciler: persist connector of volume %s error: %v", volumeID, err)
+		return
+	}
+	r.node.Driver.monitor.Watch(volumeID, c)
+
+	if len(errs) > 0 {
+		r.recorder.Eventf(ref, EventTypeWarning, "VolumeModifyFailed", "volume %s: %s", volumeID, strings.Join(errs, "; "))
+		return
+	}
+	r.recorder.Eventf(ref, EventTypeNormal, "VolumeModified", "volume %s: applied parameters of its VolumeAttributesClass", volumeID)
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateMutableParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"limits and queue", map[string]string{readIOPSKey: "100", writeBPSKey: "max", "readAheadKB": "1024"}, false},
+		{"immutable", map[string]string{encryptionKey: "true"}, true},
+		{"provisioner", map[string]string{"csi.storage.k8s.io/fstype": "xfs"}, true},
+		{"invalid limit", map[string]string{writeIOPSKey: "0"}, true},
+		{"invalid queue setting", map[string]string{"rqAffinity": "3"}, true},
+		{"connect options", map[string]string{"ctrlLossTmo": "-1", "reconnectDelay": "5"}, false},
+		{"invalid connect option", map[string]string{"reconnectDelay": "0"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateMutableParameters(tt.params); (err != nil) != tt.wantErr {
+				t.Errorf("validateMutableParameters() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseConnectOptions(t *testing.T) {
+	got, err := parseConnectOptions(map[string]string{"reconnectDelay": "10", "ctrlLossTmo": "600", readIOPSKey: "100"})
+	if err != nil {
+		t.Fatalf("parseConnectOptions() error: %v", err)
+	}
+	if want := ",ctrl_loss_tmo=600,reconnect_delay=10"; got != want {
+		t.Errorf("parseConnectOptions() = %q, want %q", got, want)
+	}
+	if _, err := parseConnectOptions(map[string]string{"ctrlLossTmo": "forever"}); err == nil {
+		t.Errorf("parseConnectOptions() accepted ctrlLossTmo forever")
+	}
+}
+
+func TestMergeMutableParameters(t *testing.T) {
+	params := map[string]string{"nqn": "nqn.test", readIOPSKey: "100", writeIOPSKey: "50"}
+	modified := map[string]string{readIOPSKey: "200", "nqn": "nqn.other", "scheduler": "none"}
+
+	got := mergeMutableParameters(params, modified)
+	want := map[string]string{"nqn": "nqn.test", readIOPSKey: "200", writeIOPSKey: "50", "scheduler": "none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeMutableParameters() = %v, want %v", got, want)
+	}
+	if params[readIOPSKey] != "100" {
+		t.Errorf("mergeMutableParameters() changed its params to %v", params)
+	}
+
+	if got := mutableParameters(want); !reflect.DeepEqual(got, map[string]string{readIOPSKey: "200", writeIOPSKey: "50", "scheduler": "none"}) {
+		t.Errorf("mutableParameters() = %v", got)
+	}
+	if got := replaceMutableParameters(params, map[string]string{"scheduler": "none"}); !reflect.DeepEqual(got, map[string]string{"nqn": "nqn.test", "scheduler": "none"}) {
+		t.Errorf("replaceMutableParameters() = %v", got)
+	}
+	if got := mutableParameters(map[string]string{"nqn": "nqn.test"}); got != nil {
+		t.Errorf("mutableParameters() without mutable keys = %v, want nil", got)
+	}
+}
+
+func TestClassParameters(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/default/persistentvolumeclaims/data", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":{"currentVolumeAttributesClassName":"fast"}}`))
+	})
+	mux.HandleFunc("/api/v1/namespaces/default/persistentvolumeclaims/plain", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":{}}`))
+	})
+	mux.HandleFunc("/api/v1/namespaces/default/persistentvolumeclaims/other", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":{"currentVolumeAttributesClassName":"foreign"}}`))
+	})
+	// a cluster serving the class only in v1beta1
+	mux.HandleFunc("/apis/storage.k8s.io/v1beta1/volumeattributesclasses/fast", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"driverName":"csi.nvmf.com","parameters":{"readIOPS":"500"}}`))
+	})
+	mux.HandleFunc("/apis/storage.k8s.io/v1/volumeattributesclasses/foreign", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"driverName":"other.csi.io","parameters":{"readIOPS":"500"}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := &attributesReconciler{
+		node: &NodeServer{Driver: &driver{name: "csi.nvmf.com"}},
+		kube: &kubeClient{apiServer: server.URL, tokenPath: tokenPath, client: server.Client()},
+	}
+
+	tests := []struct {
+		pvc     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{pvc: "data", want: map[string]string{readIOPSKey: "500"}},
+		{pvc: "plain"},
+		{pvc: "other", wantErr: true},
+		{pvc: "missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pvc, func(t *testing.T) {
+			got, err := r.classParameters(&Connector{PVCNamespace: "default", PVCName: tt.pvc})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("classParameters() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("classParameters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileFallsBackToVolumeContext(t *testing.T) {
+	d := &driver{name: "csi.nvmf.com"}
+	d.monitor = newHealthMonitor(&logEventRecorder{}, 0, nil)
+	r := &attributesReconciler{node: NewNodeServer(d), recorder: &logEventRecorder{}}
+
+	connectorFilePath := filepath.Join(t.TempDir(), "pvc-1.json")
+	c := &Connector{
+		VolumeID:    "pvc-1",
+		TargetPaths: []string{"/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount"},
+		// the volume was modified to a class setting both options, the StorageClass only ctrlLossTmo
+		MutableParameters: map[string]string{"ctrlLossTmo": "-1", "reconnectDelay": "5"},
+		ContextParameters: map[string]string{"ctrlLossTmo": "600"},
+		ConnectOptions:    ",ctrl_loss_tmo=-1,reconnect_delay=5",
+	}
+	if err := persistConnectorFile(c, connectorFilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// a class that no longer sets ctrlLossTmo nor reconnectDelay
+	r.reconcile("pvc-1", connectorFilePath, map[string]string{})
+
+	got, err := GetConnectorFromFile(connectorFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"ctrlLossTmo": "600"}; !reflect.DeepEqual(got.MutableParameters, want) {
+		t.Errorf("reconciled parameters = %v, want %v", got.MutableParameters, want)
+	}
+	if want := ",ctrl_loss_tmo=600"; got.ConnectOptions != want {
+		t.Errorf("reconciled connect options = %q, want %q", got.ConnectOptions, want)
+	}
+}
@@ -17,8 +17,11 @@ limitations under the License.
 package nvmf
 
 import (
+	"errors"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
@@ -29,12 +32,18 @@ import (
 )
 
 type NodeServer struct {
+	csi.UnimplementedNodeServer
+
 	Driver *driver
+
+	mu          sync.Mutex
+	volumeLocks map[string]bool
 }
 
 func NewNodeServer(d *driver) *NodeServer {
 	return &NodeServer{
-		Driver: d,
+		Driver:      d,
+		volumeLocks: make(map[string]bool),
 	}
 }
 
@@ -49,11 +58,39 @@ func (n *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
-func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (resp *csi.NodePublishVolumeResponse, err error) {
 	// Pre-check
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume missing Volume Capability in req.")
@@ -67,50 +104,207 @@ func (n *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume missing TargetPath in req.")
 	}
 
+	if msg := n.Driver.validateVolumeCapability(req.GetVolumeCapability(), nil); msg != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %s", msg)
+	}
+
+	if !n.lockVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "NodePublishVolume: an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer n.unlockVolume(req.GetVolumeId())
+
 	klog.Infof("VolumeID %s publish to targetPath %s.", req.GetVolumeId(), req.GetTargetPath())
+	ephemeral := isEphemeral(req.GetVolumeContext())
+	if ephemeral {
+		provisioned, created, err := n.provisionEphemeral(req)
+		if err != nil {
+			klog.Errorf("VolumeID %s provision inline volume error: %v", req.VolumeId, err)
+			return nil, status.Errorf(codes.Internal, "NodePublishVolume: provision inline volume %s error: %v", req.VolumeId, err)
+		}
+		req = provisioned
+		// a failed publish leaves no volume behind that kubelet could unpublish, unless an earlier
+		// publish of the same inline volume is still using it
+		defer func() {
+			if resp != nil || !created {
+				return
+			}
+			connectorFilePath := path.Join(DefaultVolumeMapPath, req.GetVolumeId()+".json")
+			if c, err := GetConnectorFromFile(connectorFilePath); err == nil && len(c.TargetPaths) > 0 {
+				return
+			}
+			if err := n.deprovisionEphemeral(req.GetVolumeId()); err != nil {
+				klog.Errorf("VolumeID %s delete inline volume error: %v", req.VolumeId, err)
+			}
+		}()
+	}
+
 	// Connect remote disk
 	nvmfInfo, err := getNVMfDiskInfo(req)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "NodePublishVolume: get NVMf disk info from req err: %v", err)
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: get NVMf disk info from req err: %v", err)
+	}
+	// the target tells hosts apart by hostnqn and hostid, so every node must use its own
+	if isMultiNodeAccessMode(req.GetVolumeCapability().GetAccessMode().GetMode()) && (nvmfInfo.HostNqn != "" || nvmfInfo.HostId != "") {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: volume %s is multi-node, hostNqn and hostId must not be set in its volume context", req.GetVolumeId())
 	}
 
-	connector := getNvmfConnector(nvmfInfo)
-	devicePath, err := connector.Connect()
+	reserve, preempt, err := reservationRequested(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	encrypted, err := encryptionRequested(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	if encrypted && req.GetSecrets()[encryptionPassphraseKey] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: encrypted volume %s needs a %q key in its node publish secret, node stage secrets are not used", req.GetVolumeId(), encryptionPassphraseKey)
+	}
+	if group := req.GetVolumeCapability().GetMount().GetVolumeMountGroup(); group != "" {
+		if _, err := parseMountGroup(group); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+		}
+	}
+	if _, err := parseFsckPolicy(req.GetVolumeContext()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
 
 	connectorFilePath := path.Join(DefaultVolumeMapPath, req.GetVolumeId()+".json")
+	// parameters changed by ControllerModifyVolume come with the publish context, a volume already
+	// published on this node may have been reconciled to newer ones since it was attached
+	params := mergeMutableParameters(req.GetVolumeContext(), req.GetPublishContext())
+	if existing, err := GetConnectorFromFile(connectorFilePath); err == nil && len(existing.TargetPaths) > 0 {
+		params = replaceMutableParameters(req.GetVolumeContext(), existing.MutableParameters)
+	}
+	queueSettings, err := parseQueueSettings(params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	limits, err := parseIOLimits(params)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	if nvmfInfo.ConnectOptions, err = parseConnectOptions(params); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume: %v", err)
+	}
+	// I/O limits are set on the pod's cgroup, found through the pod info kubelet passes with podInfoOnMount;
+	// it is also looked up without limits, for limits a later modify of the volume sets
+	podCgroup, err := n.Driver.throttler.podCgroup(req.GetVolumeContext()[podUIDContextKey])
+	if err != nil {
+		if limits != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "NodePublishVolume: volume %s has I/O limits: %v", req.GetVolumeId(), err)
+		}
+		podCgroup = ""
+	}
 
+	// a single writer volume may only be published to one target path, i.e. used by one pod
+	if req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		if existing, err := GetConnectorFromFile(connectorFilePath); err == nil {
+			for _, targetPath := range existing.TargetPaths {
+				if targetPath != req.GetTargetPath() {
+					return nil, status.Errorf(codes.FailedPrecondition, "NodePublishVolume: single writer volume %s is already published to %s", req.GetVolumeId(), targetPath)
+				}
+			}
+		}
+	}
+	connector, devicePath, connected, err := connectVolume(nvmfInfo, connectorFilePath)
 	if err != nil {
 		klog.Errorf("VolumeID %s failed to connect, Error: %v", req.VolumeId, err)
 		return nil, status.Errorf(codes.Internal, "VolumeID %s failed to connect, Error: %v", req.VolumeId, err)
 	}
-	if devicePath == "" {
-		klog.Errorf("VolumeID %s connected, but return nil devicePath", req.VolumeId)
-		return nil, status.Errorf(codes.Internal, "VolumeID %s connected, but return nil devicePath", req.VolumeId)
-	}
 	klog.Infof("Volume %s successful connected, Device：%s", req.VolumeId, devicePath)
-	defer Rollback(err, func() {
-		connector.Disconnect()
-	})
+	// only a connection made by this publish is rolled back, others are still used by their target paths
+	disconnect := func() {
+		if connected {
+			if err := closeEncryptedDevice(req.GetVolumeId()); err != nil {
+				klog.Errorf("VolumeID %s close encrypted device error: %v", req.VolumeId, err)
+			}
+			if err := connector.unreserve(); err != nil {
+				klog.Errorf("VolumeID %s release reservation error: %v", req.VolumeId, err)
+			}
+			connector.Disconnect()
+		}
+	}
 
-	err = persistConnectorFile(connector, connectorFilePath)
-	if err != nil {
-		klog.Errorf("failed to persist connection info: %v", err)
-		return nil, status.Errorf(codes.Internal, "VolumeID %s persist connection info error: %v", req.VolumeId, err)
+	if connected && reserve {
+		if err := connector.reserve(devicePath, req.GetVolumeCapability().GetAccessMode().GetMode(), preempt); err != nil {
+			disconnect()
+			return nil, status.Errorf(codes.FailedPrecondition, "VolumeID %s reservation error: %v", req.VolumeId, err)
+		}
 	}
 
-	// Attach disk to container path
-	if req.GetVolumeCapability().GetBlock() != nil && req.GetVolumeCapability().GetMount() != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "cannot have both block and mount access type")
+	if len(queueSettings) > 0 {
+		connector.QueueSettings = queueSettings
+		if err := connector.applyQueueSettings(); err != nil {
+			disconnect()
+			return nil, status.Errorf(codes.InvalidArgument, "VolumeID %s queue tuning error: %v", req.VolumeId, err)
+		}
 	}
-	defer Rollback(err, func() {
-		removeConnectorFile(connectorFilePath)
-	})
 
-	err = AttachDisk(req, devicePath)
+	// the mapping is opened before the read-only flag is set, so that its table stays writable for read-write
+	// target paths sharing it; a read-only publish never formats, so nothing is written to the device before
+	if encrypted {
+		devicePath, err = openEncryptedDevice(devicePath, req.GetVolumeId(), req.GetSecrets()[encryptionPassphraseKey], publishReadOnly(req))
+		if err != nil {
+			disconnect()
+			return nil, status.Errorf(codes.Internal, "VolumeID %s open encrypted device error: %v", req.VolumeId, err)
+		}
+		connector.Encrypted = true
+	}
+
+	// the device is made read-only before the pod gets it, so raw block consumers cannot write either
+	connector.addTargetPath(req.GetTargetPath())
+	connector.setTargetPathReadOnly(req.GetTargetPath(), publishReadOnly(req))
+	unpublish := func() {
+		connector.removeTargetPath(req.GetTargetPath())
+		if err := connector.applyReadOnly(); err != nil {
+			klog.Errorf("VolumeID %s restore read-only state error: %v", req.VolumeId, err)
+		}
+		disconnect()
+	}
+	if err := connector.applyReadOnly(); err != nil {
+		unpublish()
+		return nil, status.Errorf(codes.Internal, "VolumeID %s set read-only error: %v", req.VolumeId, err)
+	}
+
+	err = AttachDisk(req, devicePath, n.Driver.recorder)
 	if err != nil {
+		unpublish()
+		var corrupt *filesystemCorruptError
+		if errors.As(err, &corrupt) {
+			return nil, status.Errorf(codes.DataLoss, "VolumeID %s attach error: %v", req.VolumeId, err)
+		}
 		return nil, status.Errorf(codes.Internal, "VolumeID %s attach error: %v", req.VolumeId, err)
 	}
 
+	connector.Ephemeral = ephemeral
+	connector.PVCNamespace = req.GetVolumeContext()[pvcNamespaceContextKey]
+	connector.PVCName = req.GetVolumeContext()[pvcNameContextKey]
+	connector.EventRef = volumeObjectReference(req.GetVolumeId(), req.GetVolumeContext())
+	connector.MutableParameters = mutableParameters(params)
+	connector.ContextParameters = mutableParameters(req.GetVolumeContext())
+	if podCgroup != "" {
+		if connector.PodCgroups == nil {
+			connector.PodCgroups = make(map[string]string)
+		}
+		connector.PodCgroups[req.GetTargetPath()] = podCgroup
+	}
+	if limits != nil {
+		connector.IOLimits = limits
+		if err := connector.applyIOLimits(n.Driver.throttler); err != nil {
+			DetachDisk(req.GetTargetPath())
+			unpublish()
+			return nil, status.Errorf(codes.Internal, "VolumeID %s set I/O limits error: %v", req.VolumeId, err)
+		}
+	}
+	err = persistConnectorFile(connector, connectorFilePath)
+	if err != nil {
+		klog.Errorf("failed to persist connection info: %v", err)
+		DetachDisk(req.GetTargetPath())
+		unpublish()
+		return nil, status.Errorf(codes.Internal, "VolumeID %s persist connection info error: %v", req.VolumeId, err)
+	}
+	n.Driver.monitor.Watch(req.GetVolumeId(), connector)
+
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
@@ -125,6 +319,11 @@ func (n *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Staging TargetPath must be provided")
 	}
 
+	if !n.lockVolume(req.GetVolumeId()) {
+		return nil, status.Errorf(codes.Aborted, "NodeUnpublishVolume: an operation on volume %s is already in progress", req.GetVolumeId())
+	}
+	defer n.unlockVolume(req.GetVolumeId())
+
 	// Detach disk
 	targetPath := req.GetTargetPath()
 	err := DetachDisk(targetPath)
@@ -137,19 +336,92 @@ func (n *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpub
 	connectorFilePath := path.Join(DefaultVolumeMapPath, req.GetVolumeId()+".json")
 	connector, err := GetConnectorFromFile(connectorFilePath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			klog.Infof("NodeUnpublishVolume: volume %s is not connected, nothing to do", req.VolumeId)
+			return &csi.NodeUnpublishVolumeResponse{}, nil
+		}
 		klog.Errorf("failed to get connector from path %s Error: %v", targetPath, err)
 		return nil, status.Errorf(codes.Internal, "failed to get connector from path %s Error: %v", targetPath, err)
 	}
+
+	// an inline volume disconnected by an earlier attempt whose deletion failed
+	if connector.Ephemeral && len(connector.TargetPaths) == 0 {
+		return n.finishEphemeralUnpublish(req.GetVolumeId(), connectorFilePath)
+	}
+
+	if err := connector.clearIOLimits(n.Driver.throttler, targetPath); err != nil {
+		klog.Warningf("VolumeID: %s clear I/O limits of %s error: %v", req.VolumeId, targetPath, err)
+	}
+	// keep the connection while other target paths of the volume are published on this node
+	if connector.removeTargetPath(targetPath) {
+		if err := connector.applyReadOnly(); err != nil {
+			return nil, status.Errorf(codes.Internal, "VolumeID %s set read-only error: %v", req.VolumeId, err)
+		}
+		if err := persistConnectorFile(connector, connectorFilePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "VolumeID %s persist connection info error: %v", req.VolumeId, err)
+		}
+		n.Driver.monitor.Watch(req.GetVolumeId(), connector)
+		klog.Infof("NodeUnpublishVolume: volume %s still published to %v", req.VolumeId, connector.TargetPaths)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	if err := closeEncryptedDevice(req.GetVolumeId()); err != nil {
+		klog.Errorf("VolumeID: %s close encrypted device error: %v", req.VolumeId, err)
+		return nil, status.Errorf(codes.Internal, "VolumeID %s close encrypted device error: %v", req.VolumeId, err)
+	}
+	// a reservation left behind would fence the next node the volume is published to
+	if err := connector.unreserve(); err != nil {
+		klog.Errorf("VolumeID: %s release reservation error: %v", req.VolumeId, err)
+		return nil, status.Errorf(codes.Internal, "VolumeID %s release reservation error: %v", req.VolumeId, err)
+	}
 	err = connector.Disconnect()
 	if err != nil {
 		klog.Errorf("VolumeID: %s failed to disconnect, Error: %v", targetPath, err)
 		return nil, status.Errorf(codes.Internal, "failed to get connector from path %s Error: %v", targetPath, err)
 	}
+	n.Driver.monitor.Unwatch(req.GetVolumeId())
+
+	if connector.Ephemeral {
+		// the connector file without target paths records that only the deletion is left, for a retry to finish it
+		if err := persistConnectorFile(connector, connectorFilePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "VolumeID %s persist connection info error: %v", req.VolumeId, err)
+		}
+		return n.finishEphemeralUnpublish(req.GetVolumeId(), connectorFilePath)
+	}
 	removeConnectorFile(connectorFilePath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// finishEphemeralUnpublish deletes a disconnected inline volume, forgetting it only once it is deleted.
+func (n *NodeServer) finishEphemeralUnpublish(volumeID, connectorFilePath string) (*csi.NodeUnpublishVolumeResponse, error) {
+	if err := n.deprovisionEphemeral(volumeID); err != nil {
+		klog.Errorf("VolumeID: %s delete inline volume error: %v", volumeID, err)
+		return nil, status.Errorf(codes.Internal, "NodeUnpublishVolume: delete inline volume %s error: %v", volumeID, err)
+	}
+	removeConnectorFile(connectorFilePath)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// lockVolume serializes operations on a volume, it returns false when another one is in progress.
+func (n *NodeServer) lockVolume(volumeID string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.volumeLocks[volumeID] {
+		return false
+	}
+	n.volumeLocks[volumeID] = true
+	return true
+}
+
+func (n *NodeServer) unlockVolume(volumeID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.volumeLocks, volumeID)
+}
+
 func (n *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -181,15 +453,51 @@ func (n *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVo
 		return nil, status.Errorf(codes.Internal, "NodeExpandVolume: rescan path %s not exist", scanPath)
 	}
 
+	devicePath := filepath.Join("/dev", deviceName)
+	if connector, err := GetConnectorFromFile(path.Join(DefaultVolumeMapPath, req.GetVolumeId()+".json")); err == nil && connector.Encrypted {
+		if err := resizeEncryptedDevice(req.GetVolumeId()); err != nil {
+			klog.Errorf("NodeExpandVolume: resize encrypted device of volume %s error: %v", req.VolumeId, err)
+			return nil, status.Errorf(codes.Internal, "NodeExpandVolume: resize encrypted device of volume %s error: %v", req.VolumeId, err)
+		}
+		devicePath = luksMapperPath(req.GetVolumeId())
+	}
+
+	if req.GetVolumeCapability().GetBlock() == nil && req.GetVolumePath() != "" {
+		if err := resizeFilesystem(devicePath, req.GetVolumePath()); err != nil {
+			klog.Errorf("NodeExpandVolume: resize filesystem of volume %s error: %v", req.VolumeId, err)
+			return nil, status.Errorf(codes.Internal, "NodeExpandVolume: resize filesystem of volume %s error: %v", req.VolumeId, err)
+		}
+	}
+
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
 func (n *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	return &csi.NodeGetInfoResponse{
-		NodeId: n.Driver.nodeId,
+		NodeId:             n.Driver.nodeId,
+		AccessibleTopology: n.Driver.nodeTopology(),
 	}, nil
 }
 
 func (n *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "NodeGetVolumeStats not implement")
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats missing VolumeID in req.")
+	}
+	if len(req.GetVolumePath()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats missing VolumePath in req.")
+	}
+
+	usage, err := getVolumeUsage(req.GetVolumePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "NodeGetVolumeStats: volume path %s not found", req.GetVolumePath())
+		}
+		klog.Errorf("NodeGetVolumeStats: get usage of %s error: %v", req.GetVolumePath(), err)
+		return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats: get usage of %s error: %v", req.GetVolumePath(), err)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: n.Driver.monitor.Condition(req.GetVolumeId()),
+	}, nil
 }
@@ -18,11 +18,15 @@ package nvmf
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 	"k8s.io/utils/exec"
 	"k8s.io/utils/mount"
@@ -34,11 +38,28 @@ type nvmfDiskInfo struct {
 	Addr      string
 	Port      string
 	DeviceID  string
+	Nsid      string
 	Transport string
 	HostId    string
 	HostNqn   string
+	// ConnectOptions are set from the publish parameters, see parseConnectOptions
+	ConnectOptions string
 }
 
+// volume context keys identifying the namespace within the target subsystem
+const (
+	deviceIDKey    = "deviceID"
+	deviceUUIDKey  = "deviceUUID"
+	deviceNGUIDKey = "deviceNGUID"
+	deviceEUIKey   = "deviceEUI"
+	nsidKey        = "nsid"
+)
+
+var (
+	hexRegexp  = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
 func getNVMfDiskInfo(req *csi.NodePublishVolumeRequest) (*nvmfDiskInfo, error) {
 	volName := req.GetVolumeId()
 
@@ -48,21 +69,13 @@ func getNVMfDiskInfo(req *csi.NodePublishVolumeRequest) (*nvmfDiskInfo, error) {
 	targetTrType := volOpts["targetTrType"]
 	devHostNqn := volOpts["hostNqn"]
 	devHostId := volOpts["hostId"]
-	deviceID := volOpts["deviceID"]
-	if volOpts["deviceUUID"] != "" {
-		if deviceID != "" {
-			klog.Warningf("Warning: deviceUUID is overwriting already defined deviceID, volID: %s ", volName)
-		}
-		deviceID = strings.Join([]string{"uuid", volOpts["deviceUUID"]}, ".")
-	}
-	if volOpts["deviceEUI"] != "" {
-		if deviceID != "" {
-			klog.Warningf("Warning: deviceEUI is overwriting already defined deviceID, volID: %s ", volName)
-		}
-		deviceID = strings.Join([]string{"eui", volOpts["deviceEUI"]}, ".")
-	}
 	nqn := volOpts["nqn"]
 
+	deviceID, nsid, err := resolveDeviceID(volOpts)
+	if err != nil {
+		return nil, fmt.Errorf("%v, volID: %s ", err, volName)
+	}
+
 	if targetTrAddr == "" || nqn == "" || targetTrPort == "" || targetTrType == "" || deviceID == "" {
 		return nil, fmt.Errorf("some nvme target info is missing, volID: %s ", volName)
 	}
@@ -73,13 +86,82 @@ func getNVMfDiskInfo(req *csi.NodePublishVolumeRequest) (*nvmfDiskInfo, error) {
 		Port:      targetTrPort,
 		Nqn:       nqn,
 		DeviceID:  deviceID,
+		Nsid:      nsid,
 		Transport: targetTrType,
 		HostNqn:   devHostNqn,
 		HostId:    devHostId,
 	}, nil
 }
 
-func AttachDisk(req *csi.NodePublishVolumeRequest, devicePath string) error {
+// resolveDeviceID returns the identifier used to find the namespace and the nsid to verify the found namespace against.
+//
+// deviceID, deviceUUID, deviceNGUID and deviceEUI are globally unique. The aliases are normalized to the
+// uuid.<uuid> and eui.<hex> forms udev uses for by-id links, and when several of them are given they must all
+// name the same namespace, otherwise the request is rejected. nsid is only unique within the subsystem: on its
+// own it identifies the namespace as nsid.<nsid>, next to a globally unique identifier it is only verified.
+func resolveDeviceID(volOpts map[string]string) (deviceID, nsid string, err error) {
+	var ids []string
+	var keys []string
+	add := func(key, id string) error {
+		for i, other := range ids {
+			if !strings.EqualFold(other, id) {
+				return fmt.Errorf("conflicting namespace identifiers %s=%q and %s=%q", keys[i], volOpts[keys[i]], key, volOpts[key])
+			}
+		}
+		ids = append(ids, id)
+		keys = append(keys, key)
+		return nil
+	}
+
+	if id := volOpts[deviceIDKey]; id != "" {
+		if err := add(deviceIDKey, id); err != nil {
+			return "", "", err
+		}
+	}
+	if uuid := volOpts[deviceUUIDKey]; uuid != "" {
+		if !uuidRegexp.MatchString(uuid) {
+			return "", "", fmt.Errorf("invalid %s %q", deviceUUIDKey, uuid)
+		}
+		if err := add(deviceUUIDKey, "uuid."+strings.ToLower(uuid)); err != nil {
+			return "", "", err
+		}
+	}
+	if nguid := volOpts[deviceNGUIDKey]; nguid != "" {
+		hex := strings.ReplaceAll(nguid, "-", "")
+		if len(hex) != 32 || !hexRegexp.MatchString(hex) {
+			return "", "", fmt.Errorf("invalid %s %q, expected 32 hex digits", deviceNGUIDKey, nguid)
+		}
+		if err := add(deviceNGUIDKey, "eui."+strings.ToLower(hex)); err != nil {
+			return "", "", err
+		}
+	}
+	if eui := volOpts[deviceEUIKey]; eui != "" {
+		if !hexRegexp.MatchString(eui) {
+			return "", "", fmt.Errorf("invalid %s %q, expected hex digits", deviceEUIKey, eui)
+		}
+		if err := add(deviceEUIKey, "eui."+strings.ToLower(eui)); err != nil {
+			return "", "", err
+		}
+	}
+
+	if nsid = volOpts[nsidKey]; nsid != "" {
+		n, err := strconv.ParseUint(nsid, 10, 32)
+		if err != nil || n == 0 || n == 0xffffffff {
+			return "", "", fmt.Errorf("invalid %s %q", nsidKey, nsid)
+		}
+		nsid = strconv.FormatUint(n, 10)
+		if len(ids) == 0 {
+			return "nsid." + nsid, "", nil
+		}
+	}
+
+	if len(ids) == 0 {
+		return "", "", nil
+	}
+	return ids[0], nsid, nil
+}
+
+func AttachDisk(req *csi.NodePublishVolumeRequest, devicePath string, recorder EventRecorder) error {
 	mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
 
 	targetPath := req.GetTargetPath()
@@ -111,7 +193,11 @@ func AttachDisk(req *csi.NodePublishVolumeRequest, devicePath string) error {
 				return nil
 			}
 		}
-		if err := mounter.MountSensitive(devicePath, targetPath, "", []string{"bind"}, nil); err != nil {
+		options := []string{"bind"}
+		if publishReadOnly(req) {
+			options = append(options, "ro")
+		}
+		if err := mounter.MountSensitive(devicePath, targetPath, "", options, nil); err != nil {
 			klog.Errorf("AttachDisk: failed to mount Device %s to %s, err: %v", devicePath, targetPath, err.Error())
 			return fmt.Errorf("failed to mount Device %s to %s, err: %v", devicePath, targetPath, err.Error())
 		}
@@ -150,20 +236,36 @@ func AttachDisk(req *csi.NodePublishVolumeRequest, devicePath string) error {
 		}
 
 		fsType := req.GetVolumeCapability().GetMount().GetFsType()
-		readonly := req.GetReadonly()
-		mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
+		// reader-only access modes are mounted read-only even when the pod does not ask for it
+		readonly := publishReadOnly(req)
+		options, err := buildMountOptions(readonly, req.GetVolumeCapability().GetMount().GetMountFlags())
+		if err != nil {
+			return err
+		}
 
-		options := []string{""}
-		if readonly {
-			options = append(options, "ro")
-		} else {
-			options = append(options, "rw")
+		// kubelet leaves the fsGroup ownership to the driver, as it advertises VOLUME_MOUNT_GROUP
+		mountGroup := -1
+		if group := req.GetVolumeCapability().GetMount().GetVolumeMountGroup(); group != "" {
+			if mountGroup, err = parseMountGroup(group); err != nil {
+				return err
+			}
+			options = append(options, mountGroupOptions(fsType, mountGroup)...)
 		}
-		options = append(options, mountOptions...)
 
-		if err = mounter.FormatAndMount(devicePath, targetPath, fsType, options); err != nil {
-			klog.Errorf("AttachDisk: failed to mount Device %s to %s with options: %v", devicePath, targetPath, options)
-			return fmt.Errorf("failed to mount Device %s to %s with options: %v", devicePath, targetPath, options)
+		fsOptions, err := parseFilesystemOptions(req.GetVolumeContext(), fsType)
+		if err != nil {
+			return err
+		}
+		ref := volumeObjectReference(req.GetVolumeId(), req.GetVolumeContext())
+		if err = formatAndMount(devicePath, targetPath, fsType, options, fsOptions, recorder, ref); err != nil {
+			klog.Errorf("AttachDisk: failed to mount Device %s to %s with options %v: %v", devicePath, targetPath, options, err)
+			return fmt.Errorf("failed to mount Device %s to %s with options %v: %w", devicePath, targetPath, options, err)
+		}
+		if mountGroup >= 0 && !readonly && !mountGroupOptionFsTypes[fsType] {
+			if err := applyMountGroup(targetPath, mountGroup); err != nil {
+				mounter.Unmount(targetPath)
+				return fmt.Errorf("failed to set group %d on %s: %v", mountGroup, targetPath, err)
+			}
 		}
 	}
 
@@ -192,3 +294,74 @@ func DetachDisk(targetPath string) (err error) {
 
 	return nil
 }
+
+// resizeFilesystem grows the filesystem on devicePath, mounted at volumePath, to the size of the device.
+func resizeFilesystem(devicePath, volumePath string) error {
+	mounter := &mount.SafeFormatAndMount{Interface: mount.New(""), Exec: exec.New()}
+
+	format, err := mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to get format of %s: %v", devicePath, err)
+	}
+
+	var cmd string
+	var args []string
+	switch format {
+	case "ext2", "ext3", "ext4":
+		cmd, args = "resize2fs", []string{devicePath}
+	case "xfs":
+		// xfs can only be grown through its mount point
+		cmd, args = "xfs_growfs", []string{"-d", volumePath}
+	default:
+		return fmt.Errorf("resize of %q filesystem on %s is not supported", format, devicePath)
+	}
+
+	klog.Infof("Resize %s filesystem on %s: %s %v", format, devicePath, cmd, args)
+	if output, err := mounter.Exec.Command(cmd, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %v failed: %v, output: %s", cmd, args, err, string(output))
+	}
+	return nil
+}
+
+// getVolumeUsage reports filesystem usage for mounted volumes and the device size for block volumes
+func getVolumeUsage(volumePath string) ([]*csi.VolumeUsage, error) {
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode()&os.ModeDevice == os.ModeDevice {
+		file, err := os.Open(volumePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		size, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get size of block device %s: %v", volumePath, err)
+		}
+		return []*csi.VolumeUsage{
+			{Unit: csi.VolumeUsage_BYTES, Total: size},
+		}, nil
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		return nil, fmt.Errorf("failed to statfs %s: %v", volumePath, err)
+	}
+	blockSize := int64(statfs.Bsize)
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * blockSize,
+			Available: int64(statfs.Bavail) * blockSize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}, nil
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
 	"runtime"
@@ -32,21 +33,43 @@ import (
 	"k8s.io/klog/v2"
 )
 
-func waitForPathToExist(devicePath string, maxRetries, intervalSeconds int, deviceTransport string) (bool, error) {
+// waitForDevice waits for the namespace of the connector to show up, once per interval looking it up in sysfs
+// and falling back to the udev devicePath link. It returns early when a matching namespace is announced on added,
+// a nil added channel means polling only.
+func waitForDevice(c *Connector, devicePath string, maxRetries, intervalSeconds int, added <-chan *uevent) (string, error) {
 	for i := 0; i < maxRetries; i++ {
-		exist := utils.IsFileExisting(devicePath)
-		if exist {
-			return true, nil
+		if devName, err := findNamespaceDevice(c.TargetNqn, c.DeviceID); err == nil {
+			return filepath.Join("/dev", devName), nil
+		}
+		if utils.IsFileExisting(devicePath) {
+			return devicePath, nil
 		}
 		if i == maxRetries-1 {
 			break
 		}
-		time.Sleep(time.Second * time.Duration(intervalSeconds))
+		select {
+		case ev := <-added:
+			devNode := filepath.Join("/dev", strings.TrimPrefix(ev.DevName, "/dev/"))
+			klog.Infof("Device %s announced by uevent for device %s", devNode, c.DeviceID)
+			return devNode, nil
+		case <-time.After(time.Second * time.Duration(intervalSeconds)):
+		}
 	}
-	return false, fmt.Errorf("not found devicePath %s and transport %s", devicePath, deviceTransport)
+	return "", fmt.Errorf("not found device %s of nqn %s and transport %s", c.DeviceID, c.TargetNqn, c.Transport)
 }
 
+// GetDeviceNameByVolumeID looks the namespace of a published volume up in sysfs using its persisted connector,
+// falling back to the udev /dev/disk/by-id/nvme-uuid.<volumeID> link.
 func GetDeviceNameByVolumeID(volumeID string) (deviceName string, err error) {
+	connector, err := GetConnectorFromFile(path.Join(DefaultVolumeMapPath, volumeID+".json"))
+	if err == nil {
+		deviceName, err = findNamespaceDevice(connector.TargetNqn, connector.DeviceID)
+		if err == nil {
+			return deviceName, nil
+		}
+		klog.Warningf("volumeID %s not found in sysfs, falling back to udev link: %v", volumeID, err)
+	}
+
 	volumeLinkPath := strings.Join([]string{"/dev/disk/by-id/nvme-uuid", volumeID}, ".")
 	stat, err := os.Lstat(volumeLinkPath)
 	if err != nil {
@@ -74,6 +97,15 @@ func GetDeviceNameByVolumeID(volumeID string) (deviceName string, err error) {
 	return tmp[len(tmp)-1], nil
 }
 
+// readSysfsAttr returns the trimmed content of a sysfs attribute file
+func readSysfsAttr(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 func parseDeviceToControllerPath(deviceName string) string {
 	nvmfControllerPrefix := "/sys/class/block"
 	index := strings.LastIndex(deviceName, "n")
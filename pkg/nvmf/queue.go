@@ -0,0 +1,166 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// queueAttr maps a volume context key to an attribute of /sys/block/<dev>/queue. Attributes of the
+// request queue are set on the controller paths of a multipath head, which itself only submits bios.
+type queueAttr struct {
+	key        string
+	attr       string
+	controller bool
+	// min and max bound numeric values, scheduler is the only attribute taking a name
+	min, max int64
+}
+
+// in the order they are applied: nr_requests depends on the scheduler
+var queueAttrs = []queueAttr{
+	{key: "scheduler", attr: "scheduler", controller: true},
+	{key: "nrRequests", attr: "nr_requests", controller: true, min: 1, max: 1 << 16},
+	{key: "readAheadKB", attr: "read_ahead_kb", min: 0, max: 1 << 20},
+	{key: "maxSectorsKB", attr: "max_sectors_kb", controller: true, min: 4, max: 1 << 20},
+	{key: "rqAffinity", attr: "rq_affinity", controller: true, min: 0, max: 2},
+	{key: "ioTimeout", attr: "io_timeout", controller: true, min: 1, max: 1 << 31},
+}
+
+var queueSettingKeys = func() []string {
+	var keys []string
+	for _, a := range queueAttrs {
+		keys = append(keys, a.key)
+	}
+	return keys
+}()
+
+// queueSetting is a validated value of a queue attribute, persisted to reapply it after reconnects.
+type queueSetting struct {
+	Attr       string
+	Value      string
+	Controller bool `json:",omitempty"`
+}
+
+// parseQueueSettings reads the queue tuning of the volume context, checking values are well formed.
+// Whether the kernel allows them is only known once the device is there, see applyQueueSettings.
+func parseQueueSettings(volumeContext map[string]string) ([]queueSetting, error) {
+	var settings []queueSetting
+	for _, a := range queueAttrs {
+		value, ok := volumeContext[a.key]
+		if !ok {
+			continue
+		}
+		if a.attr == "scheduler" {
+			if value == "" || strings.ContainsAny(value, " \t\n[]") {
+				return nil, fmt.Errorf("invalid %s %q", a.key, value)
+			}
+		} else {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < a.min || n > a.max {
+				return nil, fmt.Errorf("invalid %s %q: must be an integer between %d and %d", a.key, value, a.min, a.max)
+			}
+		}
+		settings = append(settings, queueSetting{Attr: a.attr, Value: value, Controller: a.controller})
+	}
+	return settings, nil
+}
+
+// queueDevices returns the block devices a setting applies to: the paths of a multipath head for
+// request queue attributes, the device itself otherwise.
+func queueDevices(devName string, controller bool) []string {
+	if controller {
+		paths, _ := filepath.Glob(filepath.Join(SYS_BLOCK, devName, "multipath", "*"))
+		if len(paths) > 0 {
+			var devices []string
+			for _, path := range paths {
+				devices = append(devices, filepath.Base(path))
+			}
+			return devices
+		}
+	}
+	return []string{devName}
+}
+
+// checkQueueSetting validates a setting against what the kernel reports for the queue at queuePath.
+func checkQueueSetting(queuePath string, s queueSetting) error {
+	switch s.Attr {
+	case "scheduler":
+		// the available schedulers with the active one in brackets, e.g. "[mq-deadline] kyber none"
+		available, err := readSysfsAttr(filepath.Join(queuePath, "scheduler"))
+		if err != nil {
+			return err
+		}
+		for _, name := range strings.Fields(available) {
+			if strings.Trim(name, "[]") == s.Value {
+				return nil
+			}
+		}
+		return fmt.Errorf("scheduler %q is not available, the kernel offers %s", s.Value, available)
+	case "max_sectors_kb":
+		hw, err := readSysfsAttr(filepath.Join(queuePath, "max_hw_sectors_kb"))
+		if err != nil {
+			return err
+		}
+		limit, err := strconv.ParseInt(hw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid max_hw_sectors_kb %q: %v", hw, err)
+		}
+		if value, _ := strconv.ParseInt(s.Value, 10, 64); value > limit {
+			return fmt.Errorf("max_sectors_kb %s exceeds max_hw_sectors_kb %d", s.Value, limit)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(queuePath, s.Attr)); err != nil {
+		return fmt.Errorf("queue attribute %s is not supported: %v", s.Attr, err)
+	}
+	return nil
+}
+
+// applyQueueSettings validates and writes the settings to the queue of the namespace block device devName.
+func applyQueueSettings(devName string, settings []queueSetting) error {
+	for _, s := range settings {
+		for _, dev := range queueDevices(devName, s.Controller) {
+			queuePath := filepath.Join(SYS_BLOCK, dev, "queue")
+			if err := checkQueueSetting(queuePath, s); err != nil {
+				return fmt.Errorf("device %s: %v", dev, err)
+			}
+			if err := os.WriteFile(filepath.Join(queuePath, s.Attr), []byte(s.Value), 0644); err != nil {
+				return fmt.Errorf("device %s: set %s to %s: %v", dev, s.Attr, s.Value, err)
+			}
+			klog.V(4).Infof("Queue tuning: %s %s=%s", dev, s.Attr, s.Value)
+		}
+	}
+	return nil
+}
+
+// applyQueueSettings writes the connector's queue settings to its namespace, whose paths are recreated
+// by a reconnect.
+func (c *Connector) applyQueueSettings() error {
+	if len(c.QueueSettings) == 0 {
+		return nil
+	}
+	devName, err := findNamespaceDevice(c.TargetNqn, c.DeviceID)
+	if err != nil {
+		return err
+	}
+	return applyQueueSettings(devName, c.QueueSettings)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ioctlBLKROSET = 0x125d // _IO(0x12, 93)
+	ioctlBLKROGET = 0x125e // _IO(0x12, 94)
+)
+
+// publishReadOnly reports whether a publish must not write to the volume: the pod asked for it, the access
+// mode only allows readers or the mount flags hold ro.
+func publishReadOnly(req *csi.NodePublishVolumeRequest) bool {
+	readonly := req.GetReadonly() || isReadOnlyAccessMode(req.GetVolumeCapability().GetAccessMode().GetMode())
+	if mount := req.GetVolumeCapability().GetMount(); mount != nil && !readonly {
+		if options, err := buildMountOptions(false, mount.GetMountFlags()); err == nil {
+			readonly = options[0] == "ro"
+		}
+	}
+	return readonly
+}
+
+// setBlockDeviceReadOnly sets or clears the read-only flag of a block device, which the block layer enforces
+// on every writer, including pods opening a raw block volume.
+func setBlockDeviceReadOnly(devicePath string, readonly bool) error {
+	f, err := os.OpenFile(devicePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var current int32
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), ioctlBLKROGET, uintptr(unsafe.Pointer(&current))); errno != 0 {
+		return fmt.Errorf("BLKROGET %s: %v", devicePath, errno)
+	}
+	if (current != 0) == readonly {
+		return nil
+	}
+
+	var flag int32
+	if readonly {
+		flag = 1
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), ioctlBLKROSET, uintptr(unsafe.Pointer(&flag))); errno != 0 {
+		return fmt.Errorf("BLKROSET %s: %v", devicePath, errno)
+	}
+	klog.Infof("Set %s read-only: %t", devicePath, readonly)
+	return nil
+}
+
+// setTargetPathReadOnly records whether targetPath is published read-only.
+func (c *Connector) setTargetPathReadOnly(targetPath string, readonly bool) {
+	var kept []string
+	for _, p := range c.ReadOnlyPaths {
+		if p != targetPath {
+			kept = append(kept, p)
+		}
+	}
+	if readonly {
+		kept = append(kept, targetPath)
+	}
+	c.ReadOnlyPaths = kept
+}
+
+// targetPathReadOnly reports whether targetPath is published read-only.
+func (c *Connector) targetPathReadOnly(targetPath string) bool {
+	for _, p := range c.ReadOnlyPaths {
+		if p == targetPath {
+			return true
+		}
+	}
+	return false
+}
+
+// applyReadOnly makes the namespace, and its dm-crypt mapping, read-only while every target path on this node
+// is published read-only. A read-write target path sharing the connection needs a writable device, so then
+// only the read-only mounts of the other target paths protect the volume.
+func (c *Connector) applyReadOnly() error {
+	readonly := len(c.TargetPaths) > 0
+	for _, targetPath := range c.TargetPaths {
+		readonly = readonly && c.targetPathReadOnly(targetPath)
+	}
+
+	devName, err := findNamespaceDevice(c.TargetNqn, c.DeviceID)
+	if err != nil {
+		return err
+	}
+	devices := []string{filepath.Join("/dev", devName)}
+	if c.Encrypted {
+		devices = append(devices, luksMapperPath(c.VolumeID))
+	}
+	for _, device := range devices {
+		if err := setBlockDeviceReadOnly(device, readonly); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"runtime"
+	"strconv"
+	"unsafe"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// volume context keys enabling persistent reservations
+const (
+	reservationKey        = "reservation"
+	reservationPreemptKey = "reservationPreempt"
+)
+
+// NVMe I/O command opcodes of the reservation commands
+const (
+	nvmeCmdResvRegister = 0x0d
+	nvmeCmdResvReport   = 0x0e
+	nvmeCmdResvAcquire  = 0x11
+	nvmeCmdResvRelease  = 0x15
+)
+
+// reservation register actions (RREGA)
+const (
+	resvRegister   = 0
+	resvUnregister = 1
+)
+
+// reservation acquire actions (RACQA)
+const (
+	resvAcquire = 0
+	resvPreempt = 1
+)
+
+// reservation release actions (RRELA)
+const (
+	resvRelease = 0
+)
+
+// reservation types (RTYPE)
+const (
+	resvTypeNone                         = 0
+	resvTypeWriteExclusive               = 1
+	resvTypeWriteExclusiveAllRegistrants = 7
+)
+
+const (
+	// NVMe generic command status Reservation Conflict
+	nvmeStatusReservationConflict = 0x83
+	// status code type and status code, without the more and do not retry bits
+	nvmeStatusMask = 0x7ff
+
+	// _IO('N', 0x40) and _IOWR('N', 0x43, struct nvme_passthru_cmd)
+	nvmeIoctlID    = 0x4e40
+	nvmeIoctlIOCmd = 0xc0484e43
+
+	// extended report header and registrant data structures are 64 bytes each
+	resvReportHeaderSize     = 64
+	resvReportRegistrantSize = 64
+	resvReportMaxRegistrants = 64
+)
+
+// nvmePassthruCmd mirrors struct nvme_passthru_cmd of linux/nvme_ioctl.h
+type nvmePassthruCmd struct {
+	Opcode      uint8
+	Flags       uint8
+	Rsvd1       uint16
+	Nsid        uint32
+	Cdw2        uint32
+	Cdw3        uint32
+	Metadata    uint64
+	Addr        uint64
+	MetadataLen uint32
+	DataLen     uint32
+	Cdw10       uint32
+	Cdw11       uint32
+	Cdw12       uint32
+	Cdw13       uint32
+	Cdw14       uint32
+	Cdw15       uint32
+	TimeoutMs   uint32
+	Result      uint32
+}
+
+// nvmeStatusError is a command completed by the controller with a non-zero status
+type nvmeStatusError struct {
+	Opcode uint8
+	Status uint32
+}
+
+func (e *nvmeStatusError) Error() string {
+	return fmt.Sprintf("nvme command 0x%02x failed with status 0x%x", e.Opcode, e.Status)
+}
+
+func isReservationConflict(err error) bool {
+	statusErr, ok := err.(*nvmeStatusError)
+	return ok && statusErr.Status&nvmeStatusMask == nvmeStatusReservationConflict
+}
+
+// reservationRegistrant is one host registered with a namespace
+type reservationRegistrant struct {
+	ControllerID uint16
+	Holder       bool
+	Key          uint64
+	HostID       [16]byte
+}
+
+// reservationStatus is the decoded Reservation Report of a namespace
+type reservationStatus struct {
+	Generation  uint32
+	Type        uint8
+	Registrants []reservationRegistrant
+}
+
+// reservationRegisterCommand encodes Reservation Register: CDW10 carries the action in bits 2:0
+// and the data is the current key followed by the new key.
+func reservationRegisterCommand(nsid uint32, action uint8, currentKey, newKey uint64) (*nvmePassthruCmd, []byte) {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint64(data[0:8], currentKey)
+	binary.LittleEndian.PutUint64(data[8:16], newKey)
+	return &nvmePassthruCmd{
+		Opcode: nvmeCmdResvRegister,
+		Nsid:   nsid,
+		Cdw10:  uint32(action & 0x7),
+	}, data
+}
+
+// reservationAcquireCommand encodes Reservation Acquire: CDW10 carries the action in bits 2:0 and the
+// type in bits 15:8, the data is the current key followed by the key of the holder to preempt.
+func reservationAcquireCommand(nsid uint32, action, rtype uint8, currentKey, preemptKey uint64) (*nvmePassthruCmd, []byte) {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint64(data[0:8], currentKey)
+	binary.LittleEndian.PutUint64(data[8:16], preemptKey)
+	return &nvmePassthruCmd{
+		Opcode: nvmeCmdResvAcquire,
+		Nsid:   nsid,
+		Cdw10:  uint32(action&0x7) | uint32(rtype)<<8,
+	}, data
+}
+
+// reservationReleaseCommand encodes Reservation Release: CDW10 carries the action in bits 2:0 and the
+// type in bits 15:8, the data is the current key.
+func reservationReleaseCommand(nsid uint32, action, rtype uint8, currentKey uint64) (*nvmePassthruCmd, []byte) {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, currentKey)
+	return &nvmePassthruCmd{
+		Opcode: nvmeCmdResvRelease,
+		Nsid:   nsid,
+		Cdw10:  uint32(action&0x7) | uint32(rtype)<<8,
+	}, data
+}
+
+// reservationReportCommand encodes Reservation Report with extended data structures, so that registrants
+// carry their 128-bit host identifier. CDW10 is the number of dwords to transfer minus one.
+func reservationReportCommand(nsid uint32) (*nvmePassthruCmd, []byte) {
+	data := make([]byte, resvReportHeaderSize+resvReportMaxRegistrants*resvReportRegistrantSize)
+	return &nvmePassthruCmd{
+		Opcode: nvmeCmdResvReport,
+		Nsid:   nsid,
+		Cdw10:  uint32(len(data)/4 - 1),
+		Cdw11:  1,
+	}, data
+}
+
+// parseReservationReport decodes an extended Reservation Report data structure.
+func parseReservationReport(data []byte) (*reservationStatus, error) {
+	if len(data) < resvReportHeaderSize {
+		return nil, fmt.Errorf("reservation report too short: %d bytes", len(data))
+	}
+	status := &reservationStatus{
+		Generation: binary.LittleEndian.Uint32(data[0:4]),
+		Type:       data[4],
+	}
+	count := int(binary.LittleEndian.Uint16(data[5:7]))
+	for i := 0; i < count; i++ {
+		offset := resvReportHeaderSize + i*resvReportRegistrantSize
+		if offset+resvReportRegistrantSize > len(data) {
+			// the buffer only holds the first registrants
+			break
+		}
+		entry := data[offset : offset+resvReportRegistrantSize]
+		r := reservationRegistrant{
+			ControllerID: binary.LittleEndian.Uint16(entry[0:2]),
+			Holder:       entry[2]&0x1 != 0,
+			Key:          binary.LittleEndian.Uint64(entry[8:16]),
+		}
+		copy(r.HostID[:], entry[16:32])
+		status.Registrants = append(status.Registrants, r)
+	}
+	return status, nil
+}
+
+// registered reports whether key is registered with the namespace
+func (s *reservationStatus) registered(key uint64) bool {
+	for _, r := range s.Registrants {
+		if r.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// holders returns the keys holding the reservation other than key
+func (s *reservationStatus) holders(key uint64) []uint64 {
+	var keys []uint64
+	for _, r := range s.Registrants {
+		if r.Holder && r.Key != key {
+			keys = append(keys, r.Key)
+		}
+	}
+	return keys
+}
+
+// reservationKeyForHost derives the 64-bit reservation key of a node from its NVMe host identifier,
+// so that every node registers with its own stable key.
+func reservationKeyForHost(hostID string) (uint64, error) {
+	if hostID == "" {
+		return 0, fmt.Errorf("reservations need a host identifier, set it in /etc/nvme/hostid")
+	}
+	h := fnv.New64a()
+	h.Write([]byte(hostID))
+	key := h.Sum64()
+	// a zero key cannot be registered
+	if key == 0 {
+		key = 1
+	}
+	return key, nil
+}
+
+// reservationTypeForAccessMode picks the reservation of a publish: all registrants share a multi-writer
+// volume, one host holds a single-node volume and readers do not reserve at all.
+func reservationTypeForAccessMode(mode csi.VolumeCapability_AccessMode_Mode) uint8 {
+	switch {
+	case mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return resvTypeWriteExclusiveAllRegistrants
+	case isReadOnlyAccessMode(mode):
+		return resvTypeNone
+	default:
+		return resvTypeWriteExclusive
+	}
+}
+
+// reservationRequested parses the reservation flags of the volume context.
+func reservationRequested(volumeContext map[string]string) (enabled, preempt bool, err error) {
+	for _, key := range []string{reservationKey, reservationPreemptKey} {
+		value, ok := volumeContext[key]
+		if !ok {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, false, fmt.Errorf("invalid %s %q: %v", key, value, err)
+		}
+		if key == reservationKey {
+			enabled = b
+		} else {
+			preempt = b
+		}
+	}
+	return enabled, preempt, nil
+}
+
+// namespaceDevice is an open NVMe namespace block device commands are sent to
+type namespaceDevice struct {
+	file *os.File
+	nsid uint32
+}
+
+func openNamespaceDevice(devicePath string) (*namespaceDevice, error) {
+	file, err := os.Open(devicePath)
+	if err != nil {
+		return nil, err
+	}
+	nsid, err := unix.IoctlRetInt(int(file.Fd()), nvmeIoctlID)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("get nsid of %s: %v", devicePath, err)
+	}
+	return &namespaceDevice{file: file, nsid: uint32(nsid)}, nil
+}
+
+func (d *namespaceDevice) Close() error {
+	return d.file.Close()
+}
+
+// submit sends an I/O command with its data buffer, data is filled in place for commands returning data.
+func (d *namespaceDevice) submit(cmd *nvmePassthruCmd, data []byte) error {
+	if len(data) > 0 {
+		cmd.Addr = uint64(uintptr(unsafe.Pointer(&data[0])))
+		cmd.DataLen = uint32(len(data))
+	}
+	ret, _, errno := unix.Syscall(unix.SYS_IOCTL, d.file.Fd(), nvmeIoctlIOCmd, uintptr(unsafe.Pointer(cmd)))
+	runtime.KeepAlive(data)
+	if errno != 0 {
+		return fmt.Errorf("nvme command 0x%02x: %v", cmd.Opcode, errno)
+	}
+	if ret != 0 {
+		return &nvmeStatusError{Opcode: cmd.Opcode, Status: uint32(ret)}
+	}
+	return nil
+}
+
+func (d *namespaceDevice) report() (*reservationStatus, error) {
+	cmd, data := reservationReportCommand(d.nsid)
+	if err := d.submit(cmd, data); err != nil {
+		return nil, err
+	}
+	return parseReservationReport(data)
+}
+
+// acquireReservation registers key with the namespace behind devicePath and acquires a reservation of rtype.
+// A reservation held by other hosts is preempted only when preempt is set.
+func acquireReservation(devicePath string, key uint64, rtype uint8, preempt bool) error {
+	dev, err := openNamespaceDevice(devicePath)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	cmd, data := reservationRegisterCommand(dev.nsid, resvRegister, 0, key)
+	if err := dev.submit(cmd, data); err != nil {
+		// registering again conflicts on controllers implementing older revisions of the spec
+		status, rerr := dev.report()
+		if !isReservationConflict(err) || rerr != nil || !status.registered(key) {
+			return fmt.Errorf("register key %x: %v", key, err)
+		}
+	}
+
+	cmd, data = reservationAcquireCommand(dev.nsid, resvAcquire, rtype, key, 0)
+	err = dev.submit(cmd, data)
+	if err == nil || !isReservationConflict(err) {
+		return err
+	}
+
+	status, rerr := dev.report()
+	if rerr != nil {
+		return fmt.Errorf("acquire reservation: %v, report: %v", err, rerr)
+	}
+	holders := status.holders(key)
+	if !preempt {
+		return fmt.Errorf("namespace is reserved (type %d) by keys %x", status.Type, holders)
+	}
+	for _, holder := range holders {
+		klog.Warningf("Preempt reservation of key %x on %s", holder, devicePath)
+		cmd, data = reservationAcquireCommand(dev.nsid, resvPreempt, rtype, key, holder)
+		if err := dev.submit(cmd, data); err != nil {
+			return fmt.Errorf("preempt key %x: %v", holder, err)
+		}
+	}
+	return nil
+}
+
+// releaseReservation releases the reservation of key, unless it is shared by all registrants, and unregisters it.
+// Unregistering alone lets the remaining registrants of a shared reservation keep it.
+func releaseReservation(devicePath string, key uint64, rtype uint8) error {
+	dev, err := openNamespaceDevice(devicePath)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	if rtype != resvTypeWriteExclusiveAllRegistrants {
+		cmd, data := reservationReleaseCommand(dev.nsid, resvRelease, rtype, key)
+		// not holding the reservation, e.g. after being preempted, is not an error
+		if err := dev.submit(cmd, data); err != nil && !isReservationConflict(err) {
+			return fmt.Errorf("release reservation of key %x: %v", key, err)
+		}
+	}
+	cmd, data := reservationRegisterCommand(dev.nsid, resvUnregister, key, 0)
+	if err := dev.submit(cmd, data); err != nil && !isReservationConflict(err) {
+		return fmt.Errorf("unregister key %x: %v", key, err)
+	}
+	return nil
+}
+
+// reserve acquires the reservation the volume context asks for on a newly connected volume.
+func (c *Connector) reserve(devicePath string, mode csi.VolumeCapability_AccessMode_Mode, preempt bool) error {
+	rtype := reservationTypeForAccessMode(mode)
+	if rtype == resvTypeNone {
+		return nil
+	}
+	key, err := reservationKeyForHost(c.HostId)
+	if err != nil {
+		return err
+	}
+	if err := acquireReservation(devicePath, key, rtype, preempt); err != nil {
+		return err
+	}
+	klog.Infof("Volume %s: acquired reservation type %d with key %x", c.VolumeID, rtype, key)
+	c.ReservationKey, c.ReservationType = key, rtype
+	return nil
+}
+
+// unreserve releases the reservation held by this node, if any. Without the namespace device, e.g. when the
+// controller is gone, nothing can be sent and the volume must still be disconnected, so the release is skipped.
+func (c *Connector) unreserve() error {
+	if c.ReservationType == resvTypeNone {
+		return nil
+	}
+	devName, err := findNamespaceDevice(c.TargetNqn, c.DeviceID)
+	if errors.Is(err, errNamespaceNotFound) {
+		klog.Warningf("Volume %s: namespace device is gone, not releasing reservation with key %x: %v", c.VolumeID, c.ReservationKey, err)
+		c.ReservationKey, c.ReservationType = 0, resvTypeNone
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := releaseReservation("/dev/"+devName, c.ReservationKey, c.ReservationType); err != nil {
+		return err
+	}
+	klog.Infof("Volume %s: released reservation with key %x", c.VolumeID, c.ReservationKey)
+	c.ReservationKey, c.ReservationType = 0, resvTypeNone
+	return nil
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestNvmePassthruCmdSize(t *testing.T) {
+	// struct nvme_passthru_cmd is 72 bytes, encoded in the size field of nvmeIoctlIOCmd
+	size := unsafe.Sizeof(nvmePassthruCmd{})
+	if want := uintptr(nvmeIoctlIOCmd>>16) & 0x3fff; size != want {
+		t.Errorf("nvmePassthruCmd is %d bytes, want %d", size, want)
+	}
+}
+
+func le64(values ...uint64) []byte {
+	data := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(data[8*i:], v)
+	}
+	return data
+}
+
+func TestReservationCommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      *nvmePassthruCmd
+		data     []byte
+		opcode   uint8
+		cdw10    uint32
+		wantData []byte
+	}{
+		{
+			name:     "register",
+			opcode:   nvmeCmdResvRegister,
+			cdw10:    0,
+			wantData: le64(0, 0x1122334455667788),
+		},
+		{
+			name:     "unregister",
+			opcode:   nvmeCmdResvRegister,
+			cdw10:    1,
+			wantData: le64(0xabcd, 0),
+		},
+		{
+			name:     "acquire write exclusive",
+			opcode:   nvmeCmdResvAcquire,
+			cdw10:    0x100,
+			wantData: le64(0xabcd, 0),
+		},
+		{
+			name:     "preempt all registrants",
+			opcode:   nvmeCmdResvAcquire,
+			cdw10:    0x701,
+			wantData: le64(0xabcd, 0x1234),
+		},
+		{
+			name:     "release",
+			opcode:   nvmeCmdResvRelease,
+			cdw10:    0x100,
+			wantData: le64(0xabcd),
+		},
+	}
+	tests[0].cmd, tests[0].data = reservationRegisterCommand(3, resvRegister, 0, 0x1122334455667788)
+	tests[1].cmd, tests[1].data = reservationRegisterCommand(3, resvUnregister, 0xabcd, 0)
+	tests[2].cmd, tests[2].data = reservationAcquireCommand(3, resvAcquire, resvTypeWriteExclusive, 0xabcd, 0)
+	tests[3].cmd, tests[3].data = reservationAcquireCommand(3, resvPreempt, resvTypeWriteExclusiveAllRegistrants, 0xabcd, 0x1234)
+	tests[4].cmd, tests[4].data = reservationReleaseCommand(3, resvRelease, resvTypeWriteExclusive, 0xabcd)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.cmd.Opcode != tt.opcode {
+				t.Errorf("opcode = 0x%02x, want 0x%02x", tt.cmd.Opcode, tt.opcode)
+			}
+			if tt.cmd.Nsid != 3 {
+				t.Errorf("nsid = %d, want 3", tt.cmd.Nsid)
+			}
+			if tt.cmd.Cdw10 != tt.cdw10 {
+				t.Errorf("cdw10 = 0x%x, want 0x%x", tt.cmd.Cdw10, tt.cdw10)
+			}
+			if !bytes.Equal(tt.data, tt.wantData) {
+				t.Errorf("data = %x, want %x", tt.data, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestReservationReportCommand(t *testing.T) {
+	cmd, data := reservationReportCommand(7)
+	if cmd.Opcode != nvmeCmdResvReport || cmd.Nsid != 7 {
+		t.Errorf("command = %+v, want report of nsid 7", cmd)
+	}
+	wantLen := resvReportHeaderSize + resvReportMaxRegistrants*resvReportRegistrantSize
+	if len(data) != wantLen {
+		t.Fatalf("data is %d bytes, want %d", len(data), wantLen)
+	}
+	// number of dwords minus one, and the extended data structure flag
+	if cmd.Cdw10 != uint32(wantLen/4-1) || cmd.Cdw11 != 1 {
+		t.Errorf("cdw10 = %d cdw11 = %d, want %d and 1", cmd.Cdw10, cmd.Cdw11, wantLen/4-1)
+	}
+}
+
+type testRegistrant struct {
+	cntlid uint16
+	holder bool
+	key    uint64
+	hostID byte
+}
+
+func reservationReport(generation uint32, rtype uint8, count int, registrants ...testRegistrant) []byte {
+	data := make([]byte, resvReportHeaderSize+len(registrants)*resvReportRegistrantSize)
+	binary.LittleEndian.PutUint32(data[0:4], generation)
+	data[4] = rtype
+	binary.LittleEndian.PutUint16(data[5:7], uint16(count))
+	for i, r := range registrants {
+		entry := data[resvReportHeaderSize+i*resvReportRegistrantSize:]
+		binary.LittleEndian.PutUint16(entry[0:2], r.cntlid)
+		if r.holder {
+			entry[2] = 1
+		}
+		binary.LittleEndian.PutUint64(entry[8:16], r.key)
+		for j := 16; j < 32; j++ {
+			entry[j] = r.hostID
+		}
+	}
+	return data
+}
+
+func TestParseReservationReport(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		wantErr     bool
+		generation  uint32
+		rtype       uint8
+		registrants []testRegistrant
+	}{
+		{
+			name:    "too short",
+			data:    make([]byte, resvReportHeaderSize-1),
+			wantErr: true,
+		},
+		{
+			name:       "no registrants",
+			data:       reservationReport(5, resvTypeNone, 0),
+			generation: 5,
+			rtype:      resvTypeNone,
+		},
+		{
+			name: "holder and registrant",
+			data: reservationReport(9, resvTypeWriteExclusive, 2,
+				testRegistrant{cntlid: 1, holder: true, key: 0xaa, hostID: 0x11},
+				testRegistrant{cntlid: 2, key: 0xbb, hostID: 0x22}),
+			generation: 9,
+			rtype:      resvTypeWriteExclusive,
+			registrants: []testRegistrant{
+				{cntlid: 1, holder: true, key: 0xaa, hostID: 0x11},
+				{cntlid: 2, key: 0xbb, hostID: 0x22},
+			},
+		},
+		{
+			name: "truncated registrant list",
+			data: reservationReport(1, resvTypeWriteExclusiveAllRegistrants, 3,
+				testRegistrant{cntlid: 1, holder: true, key: 0xaa, hostID: 0x11}),
+			generation:  1,
+			rtype:       resvTypeWriteExclusiveAllRegistrants,
+			registrants: []testRegistrant{{cntlid: 1, holder: true, key: 0xaa, hostID: 0x11}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := parseReservationReport(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseReservationReport() = %+v, want error", status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseReservationReport() error: %v", err)
+			}
+			if status.Generation != tt.generation || status.Type != tt.rtype {
+				t.Errorf("generation %d type %d, want %d and %d", status.Generation, status.Type, tt.generation, tt.rtype)
+			}
+			if len(status.Registrants) != len(tt.registrants) {
+				t.Fatalf("got %d registrants, want %d", len(status.Registrants), len(tt.registrants))
+			}
+			for i, want := range tt.registrants {
+				got := status.Registrants[i]
+				wantHostID := bytes.Repeat([]byte{want.hostID}, 16)
+				if got.ControllerID != want.cntlid || got.Holder != want.holder || got.Key != want.key ||
+					!bytes.Equal(got.HostID[:], wantHostID) {
+					t.Errorf("registrant %d = %+v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReservationStatusKeys(t *testing.T) {
+	status, err := parseReservationReport(reservationReport(1, resvTypeWriteExclusiveAllRegistrants, 3,
+		testRegistrant{cntlid: 1, holder: true, key: 0xaa},
+		testRegistrant{cntlid: 2, holder: true, key: 0xbb},
+		testRegistrant{cntlid: 3, key: 0xcc}))
+	if err != nil {
+		t.Fatalf("parseReservationReport() error: %v", err)
+	}
+	if !status.registered(0xcc) || status.registered(0xdd) {
+		t.Errorf("registered() does not match the registrant keys")
+	}
+	if holders := status.holders(0xaa); len(holders) != 1 || holders[0] != 0xbb {
+		t.Errorf("holders(0xaa) = %x, want [bb]", holders)
+	}
+}
+
+func TestReservationKeyForHost(t *testing.T) {
+	if _, err := reservationKeyForHost(""); err == nil {
+		t.Errorf("reservationKeyForHost(\"\") succeeded, want error")
+	}
+
+	a, err := reservationKeyForHost("8f3a5c1e-0000-4000-8000-000000000001")
+	if err != nil {
+		t.Fatalf("reservationKeyForHost() error: %v", err)
+	}
+	again, _ := reservationKeyForHost("8f3a5c1e-0000-4000-8000-000000000001")
+	b, _ := reservationKeyForHost("8f3a5c1e-0000-4000-8000-000000000002")
+	if a == 0 {
+		t.Errorf("reservationKeyForHost() = 0, a zero key cannot be registered")
+	}
+	if a != again {
+		t.Errorf("reservationKeyForHost() is not stable: %x and %x", a, again)
+	}
+	if a == b {
+		t.Errorf("different hosts got the same key %x", a)
+	}
+}
+
+func TestReservationTypeForAccessMode(t *testing.T) {
+	tests := []struct {
+		mode csi.VolumeCapability_AccessMode_Mode
+		want uint8
+	}{
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, resvTypeWriteExclusive},
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER, resvTypeWriteExclusive},
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER, resvTypeWriteExclusive},
+		{csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER, resvTypeWriteExclusive},
+		{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, resvTypeWriteExclusiveAllRegistrants},
+		{csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, resvTypeNone},
+		{csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, resvTypeNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			if got := reservationTypeForAccessMode(tt.mode); got != tt.want {
+				t.Errorf("reservationTypeForAccessMode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnreserveWithoutDevice(t *testing.T) {
+	// no subsystem on the host carries this made up nqn, as after the controller was lost
+	c := &Connector{
+		VolumeID:        "vol",
+		TargetNqn:       "nqn.2021-01.io.example:vol",
+		DeviceID:        "uuid.0b6c6ae4-1b43-4b4f-9a5e-3c9f5e1d8a10",
+		ReservationKey:  0xaa,
+		ReservationType: resvTypeWriteExclusive,
+	}
+	if err := c.unreserve(); err != nil {
+		t.Fatalf("unreserve() without the namespace device error: %v", err)
+	}
+	if c.ReservationType != resvTypeNone || c.ReservationKey != 0 {
+		t.Errorf("unreserve() kept reservation key %x type %d", c.ReservationKey, c.ReservationType)
+	}
+}
@@ -17,26 +17,33 @@ limitations under the License.
 package nvmf
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-driver-nvmf/pkg/utils"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 )
 
 // Defines Non blocking GRPC server interfaces
 type NonBlockingGRPCServer interface {
 	// Start services at the endpoint
-	Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer)
+	Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) error
 	// Waits for the service to stop
-	Wait()
+	Wait() error
 	// Stops the service gracefully
 	Stop()
 	// Stops the service forcefully
 	ForceStop()
+	// Drains in-flight operations and stops the service, forcefully once ctx is done
+	Shutdown(ctx context.Context) error
 }
 
 func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
@@ -45,66 +52,155 @@ func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
-	wg     sync.WaitGroup
-	server *grpc.Server
+	wg       sync.WaitGroup
+	server   *grpc.Server
+	socket   string
+	serveErr error
+
+	// in-flight controller and node operations, drained on Shutdown
+	mu       sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
 }
 
-func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) error {
+	listener, err := s.listen(endpoint)
+	if err != nil {
+		return err
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(logGRPC, s.trackOperation),
+	}
+	server := grpc.NewServer(opts...)
+	s.mu.Lock()
+	s.server = server
+	s.mu.Unlock()
+
+	if ids != nil {
+		csi.RegisterIdentityServer(server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(server, ns)
+	}
+
+	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+
 	s.wg.Add(1)
-	go s.serve(endpoint, ids, cs, ns)
+	go s.serve(listener)
+	return nil
 }
 
-func (s *nonBlockingGRPCServer) Wait() {
+func (s *nonBlockingGRPCServer) Wait() error {
 	s.wg.Wait()
+	return s.serveErr
 }
 
 func (s *nonBlockingGRPCServer) Stop() {
 	s.server.GracefulStop()
+	s.removeSocket()
 }
 
 func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
+	s.removeSocket()
 }
 
-func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+func (s *nonBlockingGRPCServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	started := s.server != nil
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+
+	klog.Infof("Shutdown: waiting for in-flight operations to finish")
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		klog.Warningf("Shutdown: in-flight operations not finished before deadline, stopping forcefully")
+		s.ForceStop()
+		return ctx.Err()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		klog.Warningf("Shutdown: graceful stop not finished before deadline, stopping forcefully")
+		s.ForceStop()
+		return ctx.Err()
+	}
+}
 
+func (s *nonBlockingGRPCServer) listen(endpoint string) (net.Listener, error) {
 	proto, addr, err := utils.ParseEndpoint(endpoint)
 	if err != nil {
-		klog.Fatal(err.Error())
+		return nil, err
 	}
 
 	if proto == "unix" {
 		addr = "/" + addr
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			klog.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
+			return nil, fmt.Errorf("failed to remove %s, error: %s", addr, err.Error())
 		}
+		s.socket = addr
 	}
 
 	listener, err := net.Listen(proto, addr)
 	if err != nil {
-		klog.Fatalf("Failed to listen: %v", err)
+		return nil, fmt.Errorf("failed to listen: %v", err)
 	}
+	return listener, nil
+}
 
-	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
-	}
-	server := grpc.NewServer(opts...)
-	s.server = server
+func (s *nonBlockingGRPCServer) serve(listener net.Listener) {
+	defer s.wg.Done()
 
-	if ids != nil {
-		csi.RegisterIdentityServer(server, ids)
+	if err := s.server.Serve(listener); err != nil {
+		klog.Errorf("Failed to serve: %v", err)
+		s.serveErr = err
 	}
-	if cs != nil {
-		csi.RegisterControllerServer(server, cs)
+}
+
+func (s *nonBlockingGRPCServer) removeSocket() {
+	if s.socket == "" {
+		return
 	}
-	if ns != nil {
-		csi.RegisterNodeServer(server, ns)
+	if err := os.Remove(s.socket); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to remove socket %s, error: %v", s.socket, err)
 	}
+}
 
-	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+// trackOperation counts in-flight controller and node calls so that Shutdown can wait for them,
+// and refuses new ones once draining has started. Identity calls are never tracked so probes keep working.
+func (s *nonBlockingGRPCServer) trackOperation(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, "/csi.v1.Identity/") {
+		return handler(ctx, req)
+	}
 
-	err = server.Serve(listener)
-	if err != nil {
-		klog.Fatalf("Failed to server: %v", err)
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return nil, status.Errorf(codes.Unavailable, "%s rejected: plugin is shutting down", info.FullMethod)
 	}
+	s.inFlight.Add(1)
+	s.mu.Unlock()
+	defer s.inFlight.Done()
+
+	return handler(ctx, req)
 }
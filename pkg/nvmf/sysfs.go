@@ -0,0 +1,122 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// errNamespaceNotFound is returned by findNamespaceDevice when no block device of the namespace exists
+var errNamespaceNotFound = errors.New("namespace not found")
+
+// findNamespaceDevice scans the NVMe subsystems in sysfs for a namespace of subsystem nqn carrying deviceID
+// and returns its block device name, such as nvme0n1, without relying on udev links.
+func findNamespaceDevice(nqn, deviceID string) (string, error) {
+	subsystems, err := filepath.Glob(filepath.Join(SYS_NVME_SUBSYS, "*"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, subsys := range subsystems {
+		subsysnqn, err := readSysfsAttr(filepath.Join(subsys, "subsysnqn"))
+		if err != nil || subsysnqn != nqn {
+			continue
+		}
+
+		// with native multipath the namespaces hang off the subsystem, otherwise off each of its controllers
+		heads, _ := filepath.Glob(filepath.Join(subsys, "nvme*n*"))
+		paths, _ := filepath.Glob(filepath.Join(subsys, "nvme*", "nvme*n*"))
+		for _, ns := range append(heads, paths...) {
+			devName := filepath.Base(ns)
+			if !nvmeNamespaceRegexp.MatchString(devName) {
+				continue
+			}
+			if namespaceHasDeviceID(ns, deviceID) {
+				return devName, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: no namespace %s in subsystem %s", errNamespaceNotFound, deviceID, nqn)
+}
+
+// namespaceMatches reports whether the block device devName is a namespace of subsystem nqn carrying deviceID.
+func namespaceMatches(devName, nqn, deviceID string) bool {
+	blockPath := filepath.Join(SYS_BLOCK, devName)
+	// device is the subsystem for multipath heads and the controller otherwise, both expose subsysnqn
+	subsysnqn, err := readSysfsAttr(filepath.Join(blockPath, "device", "subsysnqn"))
+	if err != nil || subsysnqn != nqn {
+		return false
+	}
+	return namespaceHasDeviceID(blockPath, deviceID)
+}
+
+// namespaceHasDeviceID compares deviceID against the identifiers exposed in the namespace sysfs directory nsPath.
+// The candidates are the ones udev uses for /dev/disk/by-id/nvme-<id> links, plus nsid.<nsid> which is only
+// unique within a subsystem and so must only be used once the subsystem nqn has been checked.
+func namespaceHasDeviceID(nsPath, deviceID string) bool {
+	var candidates []string
+	if wwid, err := readSysfsAttr(filepath.Join(nsPath, "wwid")); err == nil {
+		candidates = append(candidates, wwid)
+	}
+	if uuid, err := readSysfsAttr(filepath.Join(nsPath, "uuid")); err == nil {
+		candidates = append(candidates, "uuid."+uuid)
+	}
+	for _, attr := range []string{"nguid", "eui"} {
+		if id, err := readSysfsAttr(filepath.Join(nsPath, attr)); err == nil {
+			candidates = append(candidates, "eui."+strings.ReplaceAll(id, "-", ""))
+		}
+	}
+	nsid, errNsid := readSysfsAttr(filepath.Join(nsPath, "nsid"))
+	if errNsid == nil {
+		candidates = append(candidates, "nsid."+nsid)
+	}
+	model, errModel := readSysfsAttr(filepath.Join(nsPath, "device", "model"))
+	serial, errSerial := readSysfsAttr(filepath.Join(nsPath, "device", "serial"))
+	if errModel == nil && errSerial == nil {
+		serialID := strings.Join(strings.Fields(model+" "+serial), "_")
+		candidates = append(candidates, serialID)
+		if errNsid == nil {
+			candidates = append(candidates, serialID+"_"+nsid)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if strings.EqualFold(candidate, deviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyNamespaceNsid checks that the namespace behind devicePath has the expected nsid.
+func verifyNamespaceNsid(devicePath, nsid string) error {
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return fmt.Errorf("error reading target of %q: %v", devicePath, err)
+	}
+	actual, err := readSysfsAttr(filepath.Join(SYS_BLOCK, filepath.Base(resolved), "nsid"))
+	if err != nil {
+		return fmt.Errorf("error reading nsid of %q: %v", resolved, err)
+	}
+	if actual != nsid {
+		return fmt.Errorf("namespace %s has nsid %s, but nsid %s was requested", resolved, actual, nsid)
+	}
+	return nil
+}
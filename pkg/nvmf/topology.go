@@ -0,0 +1,142 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// Topology segments are keyed topology.<driver name>/<segment>. A node reports its region, its zone
+// and one fabric-<name>=true segment per fabric it can reach. The controller runs next to the target,
+// so its own segments describe where the target is reachable from.
+const (
+	topologyRegion       = "region"
+	topologyZone         = "zone"
+	topologyFabricPrefix = "fabric-"
+	topologyFabricValue  = "true"
+)
+
+var fabricNameRegexp = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]{0,54}[A-Za-z0-9])?$`)
+
+func topologyKey(driverName, segment string) string {
+	return "topology." + driverName + "/" + segment
+}
+
+// parseFabrics splits a comma separated list of fabric names
+func parseFabrics(fabrics string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(fabrics, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !fabricNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("invalid fabric name %q: must match %s", name, fabricNameRegexp.String())
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// hasTopology reports whether a region, a zone or a fabric is configured. Without any, volumes are
+// accessible from everywhere and the driver does not advertise accessibility constraints.
+func (d *driver) hasTopology() bool {
+	return d.region != "" || d.zone != "" || len(d.fabrics) > 0
+}
+
+// nodeTopology returns the segments reported by NodeGetInfo, nil without topology.
+func (d *driver) nodeTopology() *csi.Topology {
+	if !d.hasTopology() {
+		return nil
+	}
+	segments := make(map[string]string)
+	if d.region != "" {
+		segments[topologyKey(d.name, topologyRegion)] = d.region
+	}
+	if d.zone != "" {
+		segments[topologyKey(d.name, topologyZone)] = d.zone
+	}
+	for _, fabric := range d.fabrics {
+		segments[topologyKey(d.name, topologyFabricPrefix+fabric)] = topologyFabricValue
+	}
+	return &csi.Topology{Segments: segments}
+}
+
+// targetTopologies returns where volumes of the target are accessible from: one topology per fabric
+// the target is exported on, or a single region/zone topology when no fabric is configured.
+// It is nil without topology, an empty topology would be an accessibility term no node satisfies.
+func (d *driver) targetTopologies() []*csi.Topology {
+	if !d.hasTopology() {
+		return nil
+	}
+	location := make(map[string]string)
+	if d.region != "" {
+		location[topologyKey(d.name, topologyRegion)] = d.region
+	}
+	if d.zone != "" {
+		location[topologyKey(d.name, topologyZone)] = d.zone
+	}
+
+	if len(d.fabrics) == 0 {
+		return []*csi.Topology{{Segments: location}}
+	}
+	var topologies []*csi.Topology
+	for _, fabric := range d.fabrics {
+		segments := map[string]string{topologyKey(d.name, topologyFabricPrefix+fabric): topologyFabricValue}
+		for k, v := range location {
+			segments[k] = v
+		}
+		topologies = append(topologies, &csi.Topology{Segments: segments})
+	}
+	return topologies
+}
+
+// reachableTopologies returns the target topologies a node matching one of the requisite topologies can use.
+// Without requirements every target topology is reachable.
+func reachableTopologies(targets []*csi.Topology, requirement *csi.TopologyRequirement) []*csi.Topology {
+	var requested []*csi.Topology
+	requested = append(requested, requirement.GetRequisite()...)
+	requested = append(requested, requirement.GetPreferred()...)
+	if len(requested) == 0 {
+		return targets
+	}
+
+	var reachable []*csi.Topology
+	for _, target := range targets {
+		for _, req := range requested {
+			if topologyCovers(req, target) {
+				reachable = append(reachable, target)
+				break
+			}
+		}
+	}
+	return reachable
+}
+
+// topologyCovers reports whether a node in topology node satisfies every segment of target
+func topologyCovers(node, target *csi.Topology) bool {
+	for key, value := range target.GetSegments() {
+		if node.GetSegments()[key] != value {
+			return false
+		}
+	}
+	return true
+}
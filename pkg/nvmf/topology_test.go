@@ -0,0 +1,75 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestTargetTopologies(t *testing.T) {
+	const name = "csi.nvmf.com"
+	tests := []struct {
+		name        string
+		driver      *driver
+		want        []*csi.Topology
+		constraints bool
+	}{
+		{"none", &driver{name: name}, nil, false},
+		{
+			name:        "zone",
+			driver:      &driver{name: name, region: "eu", zone: "eu-1"},
+			want:        []*csi.Topology{{Segments: map[string]string{"topology.csi.nvmf.com/region": "eu", "topology.csi.nvmf.com/zone": "eu-1"}}},
+			constraints: true,
+		},
+		{
+			name:   "fabrics",
+			driver: &driver{name: name, fabrics: []string{"rdma", "tcp"}},
+			want: []*csi.Topology{
+				{Segments: map[string]string{"topology.csi.nvmf.com/fabric-rdma": "true"}},
+				{Segments: map[string]string{"topology.csi.nvmf.com/fabric-tcp": "true"}},
+			},
+			constraints: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.driver.targetTopologies(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("targetTopologies() = %v, want %v", got, tt.want)
+			}
+
+			ids := &IdentityServer{Driver: tt.driver}
+			resp, err := ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			constraints := false
+			for _, capability := range resp.GetCapabilities() {
+				if capability.GetService().GetType() == csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS {
+					constraints = true
+				}
+			}
+			if constraints != tt.constraints {
+				t.Errorf("VOLUME_ACCESSIBILITY_CONSTRAINTS advertised = %t, want %t", constraints, tt.constraints)
+			}
+		})
+	}
+}
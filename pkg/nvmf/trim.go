@@ -0,0 +1,359 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/mount"
+)
+
+const (
+	// StorageClass parameter discarding the whole namespace before the backend deletes it
+	discardOnDeleteKey = "discardOnDelete"
+
+	// set by the external-provisioner with --extra-create-metadata and handed to the node in the volume context
+	pvcNameContextKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceContextKey = "csi.storage.k8s.io/pvc/namespace"
+
+	// PVC annotation requesting an fstrim of the volume whenever its value changes, <driver name>/fstrim
+	trimAnnotationSuffix = "/fstrim"
+
+	// how often the trimmer looks for due volumes and trim requests
+	trimPollInterval = time.Minute
+	// how long the fstrim annotation of a PVC is cached, so nodes do not query every claim on every poll
+	trimRequestRefresh = 10 * time.Minute
+
+	ioctlFITRIM     = 0xc0185879 // _IOWR('X', 121, struct fstrim_range)
+	ioctlBLKDISCARD = 0x1277     // _IO(0x12, 119)
+)
+
+type fstrimRange struct {
+	start  uint64
+	len    uint64
+	minLen uint64
+}
+
+// discardOnDeleteRequested parses the discardOnDelete flag of the parameters.
+func discardOnDeleteRequested(params map[string]string) (bool, error) {
+	value, ok := params[discardOnDeleteKey]
+	if !ok {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", discardOnDeleteKey, value, err)
+	}
+	return enabled, nil
+}
+
+// fitrim discards the unused blocks of the filesystem mounted at mountPath and returns the bytes discarded.
+func fitrim(mountPath string) (uint64, error) {
+	dir, err := os.Open(mountPath)
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+
+	r := fstrimRange{len: math.MaxUint64}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), ioctlFITRIM, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return 0, fmt.Errorf("FITRIM %s: %v", mountPath, errno)
+	}
+	// the kernel reports the discarded bytes in len
+	return r.len, nil
+}
+
+// discardImage discards all blocks of a namespace's backing store: a block device with BLKDISCARD and
+// a file by punching a hole over its whole size.
+func discardImage(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeDevice != 0 {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("get size of %s: %v", path, err)
+		}
+		r := [2]uint64{0, uint64(size)}
+		if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), ioctlBLKDISCARD, uintptr(unsafe.Pointer(&r))); errno != 0 {
+			return fmt.Errorf("BLKDISCARD %s: %v", path, errno)
+		}
+		return nil
+	}
+	if err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, info.Size()); err != nil {
+		return fmt.Errorf("punch hole in %s: %v", path, err)
+	}
+	return nil
+}
+
+// trimMetrics counts the fstrim runs on each volume, served in the Prometheus text format.
+type trimMetrics struct {
+	mu        sync.Mutex
+	succeeded map[string]uint64
+	failed    map[string]uint64
+	reclaimed map[string]uint64
+	lastRun   map[string]time.Time
+}
+
+func newTrimMetrics() *trimMetrics {
+	return &trimMetrics{
+		succeeded: make(map[string]uint64),
+		failed:    make(map[string]uint64),
+		reclaimed: make(map[string]uint64),
+		lastRun:   make(map[string]time.Time),
+	}
+}
+
+func (m *trimMetrics) record(volumeID string, reclaimed uint64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.failed[volumeID]++
+	} else {
+		m.succeeded[volumeID]++
+		m.reclaimed[volumeID] += reclaimed
+	}
+	m.lastRun[volumeID] = time.Now()
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *trimMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var volumes []string
+	for volumeID := range m.lastRun {
+		volumes = append(volumes, volumeID)
+	}
+	sort.Strings(volumes)
+
+	var b strings.Builder
+	b.WriteString("# HELP nvmf_fstrim_runs_total Number of fstrim runs on a volume by result.\n")
+	b.WriteString("# TYPE nvmf_fstrim_runs_total counter\n")
+	for _, volumeID := range volumes {
+		fmt.Fprintf(&b, "nvmf_fstrim_runs_total{volume_id=%q,result=\"success\"} %d\n", volumeID, m.succeeded[volumeID])
+		fmt.Fprintf(&b, "nvmf_fstrim_runs_total{volume_id=%q,result=\"failure\"} %d\n", volumeID, m.failed[volumeID])
+	}
+	b.WriteString("# HELP nvmf_fstrim_reclaimed_bytes_total Bytes discarded by fstrim on a volume.\n")
+	b.WriteString("# TYPE nvmf_fstrim_reclaimed_bytes_total counter\n")
+	for _, volumeID := range volumes {
+		fmt.Fprintf(&b, "nvmf_fstrim_reclaimed_bytes_total{volume_id=%q} %d\n", volumeID, m.reclaimed[volumeID])
+	}
+	b.WriteString("# HELP nvmf_fstrim_last_run_timestamp_seconds Time of the last fstrim run on a volume.\n")
+	b.WriteString("# TYPE nvmf_fstrim_last_run_timestamp_seconds gauge\n")
+	for _, volumeID := range volumes {
+		fmt.Fprintf(&b, "nvmf_fstrim_last_run_timestamp_seconds{volume_id=%q} %d\n", volumeID, m.lastRun[volumeID].Unix())
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+type trimState struct {
+	lastRun     time.Time
+	lastRequest string
+	// request is the fstrim annotation of the PVC as last read at fetched
+	request string
+	fetched time.Time
+}
+
+// trimmer runs FITRIM on the filesystems of the volumes published on this node, every interval and
+// whenever the fstrim annotation of their PVC changes, so that thin targets get their free space back.
+type trimmer struct {
+	node       *NodeServer
+	interval   time.Duration
+	kube       *kubeClient
+	annotation string
+	recorder   EventRecorder
+	metrics    *trimMetrics
+
+	states   map[string]*trimState
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newTrimmer(node *NodeServer, interval time.Duration, recorder EventRecorder, metrics *trimMetrics) *trimmer {
+	kube, err := newKubeClient()
+	if err != nil {
+		klog.Warningf("Trimmer: fstrim annotations of PVCs are ignored: %v", err)
+	}
+	return &trimmer{
+		node:       node,
+		interval:   interval,
+		kube:       kube,
+		annotation: node.Driver.name + trimAnnotationSuffix,
+		recorder:   recorder,
+		metrics:    metrics,
+		states:     make(map[string]*trimState),
+		stopCh:     make(chan struct{}),
+	}
+}
+
+// Run checks the published volumes every trimPollInterval until Stop is called.
+func (t *trimmer) Run() {
+	poll := trimPollInterval
+	if t.interval > 0 && t.interval < poll {
+		poll = t.interval
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.check()
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+func (t *trimmer) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stopCh)
+	})
+}
+
+func (t *trimmer) check() {
+	files, err := filepath.Glob(filepath.Join(DefaultVolumeMapPath, "*.json"))
+	if err != nil {
+		klog.Errorf("Trimmer: list connector files error: %v", err)
+		return
+	}
+
+	published := make(map[string]bool)
+	for _, file := range files {
+		volumeID := strings.TrimSuffix(filepath.Base(file), ".json")
+		published[volumeID] = true
+		c, err := GetConnectorFromFile(file)
+		if err != nil {
+			continue
+		}
+
+		state, ok := t.states[volumeID]
+		if !ok {
+			// volumes are first trimmed one interval after they are seen, not all at once on startup
+			state = &trimState{lastRun: time.Now()}
+			t.states[volumeID] = state
+		}
+
+		due := t.interval > 0 && time.Since(state.lastRun) >= t.interval
+		if state.fetched.IsZero() || time.Since(state.fetched) >= trimRequestRefresh {
+			state.request = t.trimRequest(c)
+			state.fetched = time.Now()
+		}
+		request := state.request
+		if !due && (request == "" || request == state.lastRequest) {
+			continue
+		}
+		// a busy volume keeps its schedule and request, so that the next poll trims it
+		if t.trim(volumeID, c, request != "" && request != state.lastRequest) {
+			state.lastRun = time.Now()
+			state.lastRequest = request
+		}
+	}
+	for volumeID := range t.states {
+		if !published[volumeID] {
+			delete(t.states, volumeID)
+		}
+	}
+}
+
+// trimRequest returns the value of the fstrim annotation of the volume's PVC, if any.
+func (t *trimmer) trimRequest(c *Connector) string {
+	if t.kube == nil || c.PVCName == "" {
+		return ""
+	}
+	annotations, err := t.kube.getAnnotations(c.PVCNamespace, "persistentvolumeclaims/"+c.PVCName)
+	if err != nil {
+		klog.Warningf("Trimmer: get annotations of PVC %s/%s error: %v", c.PVCNamespace, c.PVCName, err)
+		return ""
+	}
+	return annotations[t.annotation]
+}
+
+// trim runs FITRIM on one mount point of the volume, recording the result on the PVC when it was requested there.
+// It returns false when the volume is busy and has to be trimmed later.
+func (t *trimmer) trim(volumeID string, c *Connector, requested bool) bool {
+	mountPath := trimMountPath(c)
+	if mountPath == "" {
+		klog.V(4).Infof("Trimmer: volume %s has no writable filesystem mount, nothing to trim", volumeID)
+		return true
+	}
+	if !t.node.lockVolume(volumeID) {
+		klog.Infof("Trimmer: volume %s is busy, trimming it later", volumeID)
+		return false
+	}
+	reclaimed, err := fitrim(mountPath)
+	t.node.unlockVolume(volumeID)
+	t.metrics.record(volumeID, reclaimed, err)
+
+	var ref *ObjectReference
+	if requested {
+		ref = &ObjectReference{Kind: "PersistentVolumeClaim", Namespace: c.PVCNamespace, Name: c.PVCName, APIVersion: "v1"}
+	}
+	if err != nil {
+		klog.Errorf("Trimmer: fstrim of volume %s at %s error: %v", volumeID, mountPath, err)
+		if ref != nil {
+			t.recorder.Eventf(ref, EventTypeWarning, "VolumeTrimFailed", "fstrim of volume %s failed: %v", volumeID, err)
+		}
+		return true
+	}
+	klog.Infof("Trimmer: fstrim of volume %s at %s discarded %d bytes", volumeID, mountPath, reclaimed)
+	if ref != nil {
+		t.recorder.Eventf(ref, EventTypeNormal, "VolumeTrimmed", "fstrim of volume %s discarded %d bytes", volumeID, reclaimed)
+	}
+	return true
+}
+
+// trimMountPath returns a read-write filesystem mount point of the volume, block volumes have none and
+// FITRIM fails on read-only mounts.
+func trimMountPath(c *Connector) string {
+	mounter := mount.New("")
+	for _, targetPath := range c.TargetPaths {
+		if c.targetPathReadOnly(targetPath) {
+			continue
+		}
+		info, err := os.Stat(targetPath)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		if notMounted, err := mounter.IsLikelyNotMountPoint(targetPath); err == nil && !notMounted {
+			return targetPath
+		}
+	}
+	return ""
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ueventBufferSize = 64 * 1024
+	// kernel uevents are multicast to group 1, udev re-broadcasts to group 2
+	ueventKernelGroup = 1
+
+	ueventMinBackoff = 100 * time.Millisecond
+	ueventMaxBackoff = 10 * time.Second
+)
+
+// matches namespace block devices such as nvme0n1, but not hidden multipath paths such as nvme0c1n1
+var nvmeNamespaceRegexp = regexp.MustCompile(`^nvme\d+n\d+$`)
+
+// matches the hidden multipath path devices of a namespace, such as nvme0c1n1
+var nvmePathRegexp = regexp.MustCompile(`^nvme\d+c\d+n\d+$`)
+
+// ueventWatcher is the node-wide listener used to wake up waiting connects, nil when unavailable
+var ueventWatcher *ueventListener
+
+// uevent is a kernel kobject uevent such as "add@/devices/.../block/nvme0n1"
+type uevent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	DevName   string
+	DevType   string
+	Env       map[string]string
+}
+
+// parseUevent parses a kernel uevent message: a "action@devpath" header followed by
+// NUL separated KEY=VALUE pairs.
+func parseUevent(msg []byte) (*uevent, error) {
+	fields := bytes.Split(msg, []byte{0})
+	header := string(fields[0])
+	at := strings.Index(header, "@")
+	if at <= 0 {
+		return nil, fmt.Errorf("invalid uevent header %q", header)
+	}
+
+	ev := &uevent{
+		Action:  header[:at],
+		DevPath: header[at+1:],
+		Env:     make(map[string]string),
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(string(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		ev.Env[kv[0]] = kv[1]
+	}
+	if action := ev.Env["ACTION"]; action != "" {
+		ev.Action = action
+	}
+	if devPath := ev.Env["DEVPATH"]; devPath != "" {
+		ev.DevPath = devPath
+	}
+	ev.Subsystem = ev.Env["SUBSYSTEM"]
+	ev.DevName = ev.Env["DEVNAME"]
+	ev.DevType = ev.Env["DEVTYPE"]
+	return ev, nil
+}
+
+// isNvmeNamespaceAdd reports whether the event announces a new NVMe namespace block device
+func (ev *uevent) isNvmeNamespaceAdd() bool {
+	return ev.Action == "add" && ev.Subsystem == "block" && ev.DevType == "disk" &&
+		nvmeNamespaceRegexp.MatchString(strings.TrimPrefix(ev.DevName, "/dev/"))
+}
+
+// isNvmePathAdd reports whether the event announces a new multipath path of an NVMe namespace
+func (ev *uevent) isNvmePathAdd() bool {
+	return ev.Action == "add" && ev.Subsystem == "block" && ev.DevType == "disk" &&
+		nvmePathRegexp.MatchString(strings.TrimPrefix(ev.DevName, "/dev/"))
+}
+
+// ueventSource delivers raw uevent messages, one per Read.
+type ueventSource interface {
+	Read() ([]byte, error)
+	Close() error
+}
+
+type netlinkUeventSource struct {
+	file *os.File
+	buf  []byte
+}
+
+// newNetlinkUeventSource subscribes to kernel uevents on a NETLINK_KOBJECT_UEVENT socket
+func newNetlinkUeventSource() (*netlinkUeventSource, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("create uevent socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: ueventKernelGroup}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("bind uevent socket: %v", err)
+	}
+
+	// non-blocking fd lets the runtime poller unblock Read on Close
+	return &netlinkUeventSource{
+		file: os.NewFile(uintptr(fd), "uevent"),
+		buf:  make([]byte, ueventBufferSize),
+	}, nil
+}
+
+func (s *netlinkUeventSource) Read() ([]byte, error) {
+	n, err := s.file.Read(s.buf)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	copy(msg, s.buf[:n])
+	return msg, nil
+}
+
+func (s *netlinkUeventSource) Close() error {
+	return s.file.Close()
+}
+
+type ueventSubscriber struct {
+	match func(*uevent) bool
+	ch    chan *uevent
+}
+
+// ueventListener dispatches uevents from a source to the subscribers whose match function accepts them.
+type ueventListener struct {
+	source ueventSource
+
+	mu          sync.Mutex
+	nextID      int
+	subscribers map[int]*ueventSubscriber
+}
+
+func newUeventListener(source ueventSource) *ueventListener {
+	return &ueventListener{
+		source:      source,
+		subscribers: make(map[int]*ueventSubscriber),
+	}
+}
+
+// startUeventWatcher starts the node-wide netlink listener, leaving connects on polling if that fails
+func startUeventWatcher() {
+	source, err := newNetlinkUeventSource()
+	if err != nil {
+		klog.Warningf("Uevent listener disabled, falling back to polling for devices: %v", err)
+		return
+	}
+	ueventWatcher = newUeventListener(source)
+	go ueventWatcher.Run()
+}
+
+func stopUeventWatcher() {
+	if ueventWatcher != nil {
+		ueventWatcher.Close()
+	}
+}
+
+// Run reads events until the source is closed, backing off while reads keep failing.
+func (l *ueventListener) Run() {
+	backoff := ueventMinBackoff
+	for {
+		msg, err := l.source.Read()
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			// ENOBUFS means events were dropped, waiters fall back to polling for those
+			if errors.Is(err, unix.ENOBUFS) {
+				klog.Warningf("Uevent: events dropped: %v", err)
+				continue
+			}
+			klog.Warningf("Uevent: read error, retrying in %v: %v", backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > ueventMaxBackoff {
+				backoff = ueventMaxBackoff
+			}
+			continue
+		}
+		backoff = ueventMinBackoff
+		l.handle(msg)
+	}
+}
+
+func (l *ueventListener) Close() error {
+	return l.source.Close()
+}
+
+// handle parses one raw message and hands it to every matching subscriber without blocking.
+func (l *ueventListener) handle(msg []byte) {
+	ev, err := parseUevent(msg)
+	if err != nil {
+		klog.V(5).Infof("Uevent: skip message: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, sub := range l.subscribers {
+		if !sub.match(ev) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events accepted by match; cancel must be called when done.
+func (l *ueventListener) Subscribe(match func(*uevent) bool) (<-chan *uevent, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := l.nextID
+	l.nextID++
+	sub := &ueventSubscriber{match: match, ch: make(chan *uevent, 16)}
+	l.subscribers[id] = sub
+
+	return sub.ch, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subscribers, id)
+	}
+}
+
+// subscribeNvmeDevice subscribes to added namespaces of subsystem nqn whose identifiers match deviceID,
+// returning a nil channel when no listener is running.
+func subscribeNvmeDevice(nqn, deviceID string) (<-chan *uevent, func()) {
+	if ueventWatcher == nil {
+		return nil, func() {}
+	}
+	return ueventWatcher.Subscribe(func(ev *uevent) bool {
+		return ev.isNvmeNamespaceAdd() && namespaceMatches(strings.TrimPrefix(ev.DevName, "/dev/"), nqn, deviceID)
+	})
+}
+
+// subscribeNvmeNamespaces subscribes to every added namespace and multipath path device, returning a nil
+// channel when no listener is running.
+func subscribeNvmeNamespaces() (<-chan *uevent, func()) {
+	if ueventWatcher == nil {
+		return nil, func() {}
+	}
+	return ueventWatcher.Subscribe(func(ev *uevent) bool {
+		return ev.isNvmeNamespaceAdd() || ev.isNvmePathAdd()
+	})
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nvmf
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeUeventSource replays queued messages and errors, then blocks until closed.
+type fakeUeventSource struct {
+	msgs   chan []byte
+	errs   chan error
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFakeUeventSource() *fakeUeventSource {
+	return &fakeUeventSource{
+		msgs:   make(chan []byte, 16),
+		errs:   make(chan error, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (s *fakeUeventSource) Read() ([]byte, error) {
+	select {
+	case err := <-s.errs:
+		return nil, err
+	default:
+	}
+	select {
+	case msg := <-s.msgs:
+		return msg, nil
+	case err := <-s.errs:
+		return nil, err
+	case <-s.closed:
+		return nil, os.ErrClosed
+	}
+}
+
+func (s *fakeUeventSource) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func ueventMessage(header string, env ...string) []byte {
+	return []byte(strings.Join(append([]string{header}, env...), "\x00"))
+}
+
+func TestParseUevent(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    *uevent
+		wantErr bool
+	}{
+		{
+			name: "namespace add",
+			msg: ueventMessage("add@/devices/virtual/nvme-subsystem/nvme-subsys0/nvme0n1",
+				"ACTION=add", "DEVPATH=/devices/virtual/nvme-subsystem/nvme-subsys0/nvme0n1",
+				"SUBSYSTEM=block", "DEVNAME=nvme0n1", "DEVTYPE=disk", "SEQNUM=1234"),
+			want: &uevent{
+				Action:    "add",
+				DevPath:   "/devices/virtual/nvme-subsystem/nvme-subsys0/nvme0n1",
+				Subsystem: "block",
+				DevName:   "nvme0n1",
+				DevType:   "disk",
+			},
+		},
+		{
+			name: "environment overrides header",
+			msg:  ueventMessage("add@/devices/a", "ACTION=change", "DEVPATH=/devices/b", "SUBSYSTEM=block"),
+			want: &uevent{Action: "change", DevPath: "/devices/b", Subsystem: "block"},
+		},
+		{
+			name: "header only",
+			msg:  ueventMessage("remove@/devices/a"),
+			want: &uevent{Action: "remove", DevPath: "/devices/a"},
+		},
+		{
+			name: "malformed fields are skipped",
+			msg:  ueventMessage("add@/devices/a", "garbage", "", "SUBSYSTEM=nvme"),
+			want: &uevent{Action: "add", DevPath: "/devices/a", Subsystem: "nvme"},
+		},
+		{
+			name:    "udev message",
+			msg:     ueventMessage("libudev", "ACTION=add"),
+			wantErr: true,
+		},
+		{
+			name:    "missing action",
+			msg:     ueventMessage("@/devices/a"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := parseUevent(tt.msg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseUevent() = %+v, want error", ev)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseUevent() error: %v", err)
+			}
+			if ev.Action != tt.want.Action || ev.DevPath != tt.want.DevPath || ev.Subsystem != tt.want.Subsystem ||
+				ev.DevName != tt.want.DevName || ev.DevType != tt.want.DevType {
+				t.Errorf("parseUevent() = %+v, want %+v", ev, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNvmeNamespaceAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   uevent
+		want bool
+	}{
+		{"namespace", uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "nvme0n1"}, true},
+		{"dev prefix", uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "/dev/nvme12n3"}, true},
+		{"multipath path", uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "nvme0c1n1"}, false},
+		{"partition", uevent{Action: "add", Subsystem: "block", DevType: "partition", DevName: "nvme0n1p1"}, false},
+		{"remove", uevent{Action: "remove", Subsystem: "block", DevType: "disk", DevName: "nvme0n1"}, false},
+		{"controller", uevent{Action: "add", Subsystem: "nvme", DevName: "nvme0"}, false},
+		{"other disk", uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "sda"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ev.isNvmeNamespaceAdd(); got != tt.want {
+				t.Errorf("isNvmeNamespaceAdd() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNvmePathAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		ev   uevent
+		want bool
+	}{
+		{"multipath path", uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "nvme0c1n1"}, true},
+		{"namespace", uevent{Action: "add", Subsystem: "block", DevType: "disk", DevName: "nvme0n1"}, false},
+		{"remove", uevent{Action: "remove", Subsystem: "block", DevType: "disk", DevName: "nvme0c1n1"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ev.isNvmePathAdd(); got != tt.want {
+				t.Errorf("isNvmePathAdd() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthMonitorRunWithoutChecks(t *testing.T) {
+	m := newHealthMonitor(&logEventRecorder{}, 0, nil)
+	done := make(chan struct{})
+	go func() {
+		m.Run()
+		close(done)
+	}()
+	m.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+func TestUeventListenerDispatch(t *testing.T) {
+	source := newFakeUeventSource()
+	l := newUeventListener(source)
+	done := make(chan struct{})
+	go func() {
+		l.Run()
+		close(done)
+	}()
+
+	namespaces, cancelNamespaces := l.Subscribe((*uevent).isNvmeNamespaceAdd)
+	defer cancelNamespaces()
+	all, cancelAll := l.Subscribe(func(*uevent) bool { return true })
+
+	source.msgs <- ueventMessage("add@/devices/nvme0c1n1", "ACTION=add", "SUBSYSTEM=block", "DEVTYPE=disk", "DEVNAME=nvme0c1n1")
+	source.msgs <- []byte("libudev")
+	source.msgs <- ueventMessage("add@/devices/nvme0n1", "ACTION=add", "SUBSYSTEM=block", "DEVTYPE=disk", "DEVNAME=nvme0n1")
+
+	select {
+	case ev := <-namespaces:
+		if ev.DevName != "nvme0n1" {
+			t.Errorf("namespace subscriber got %s, want nvme0n1", ev.DevName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("namespace subscriber got no event")
+	}
+	for _, want := range []string{"nvme0c1n1", "nvme0n1"} {
+		select {
+		case ev := <-all:
+			if ev.DevName != want {
+				t.Errorf("subscriber got %s, want %s", ev.DevName, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("subscriber got no event for %s", want)
+		}
+	}
+
+	// a cancelled subscriber gets nothing more
+	cancelAll()
+	source.msgs <- ueventMessage("add@/devices/nvme1n1", "ACTION=add", "SUBSYSTEM=block", "DEVTYPE=disk", "DEVNAME=nvme1n1")
+	select {
+	case ev := <-namespaces:
+		if ev.DevName != "nvme1n1" {
+			t.Errorf("namespace subscriber got %s, want nvme1n1", ev.DevName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("namespace subscriber got no event")
+	}
+	select {
+	case ev := <-all:
+		t.Errorf("cancelled subscriber got %s", ev.DevName)
+	default:
+	}
+
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
+
+func TestUeventListenerReadErrors(t *testing.T) {
+	source := newFakeUeventSource()
+	l := newUeventListener(source)
+	sub, cancel := l.Subscribe(func(*uevent) bool { return true })
+	defer cancel()
+
+	source.errs <- unix.ENOBUFS
+	source.errs <- errors.New("transient")
+	source.msgs <- ueventMessage("add@/devices/nvme0n1", "ACTION=add", "DEVNAME=nvme0n1")
+
+	done := make(chan struct{})
+	go func() {
+		l.Run()
+		close(done)
+	}()
+
+	select {
+	case ev := <-sub:
+		if ev.DevName != "nvme0n1" {
+			t.Errorf("subscriber got %s, want nvme0n1", ev.DevName)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener stopped dispatching after read errors")
+	}
+
+	l.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}